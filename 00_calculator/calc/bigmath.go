@@ -0,0 +1,127 @@
+package calc
+
+import (
+	"errors"
+	"math/big"
+)
+
+/*big.Float has no transcendental functions, so "^" with a
+non-integer exponent is computed as exp(b * ln(a)). Both series are
+evaluated with guard bits on top of the requested precision
+*/
+const guardBits = 64
+
+func bigPow(a, b *big.Float, prec uint) (*big.Float, error) {
+	if b.IsInt() {
+		n, _ := b.Int(nil)
+		return bigPowInt(a, n, prec)
+	}
+	switch a.Sign() {
+	case -1:
+		return nil, errors.New("Negative base with a fractional exponent")
+	case 0:
+		if b.Sign() < 0 {
+			return nil, errors.New("Division by zero")
+		}
+		return new(big.Float).SetPrec(prec), nil
+	}
+	wp := prec + guardBits
+	l := bigLn(a, wp)
+	l.Mul(l, b)
+	out, err := bigExp(l, wp)
+	if err != nil {
+		return nil, err
+	}
+	return out.SetPrec(prec), nil
+}
+
+/*bigPowInt computes a^n by squaring, negative exponents are 1/a^-n
+ */
+func bigPowInt(a *big.Float, n *big.Int, prec uint) (*big.Float, error) {
+	if n.Sign() < 0 && a.Sign() == 0 {
+		return nil, errors.New("Division by zero")
+	}
+	if n.BitLen() > 32 && a.MantExp(nil) > 1 {
+		return nil, errors.New("Exponent too large")
+	}
+	wp := prec + guardBits
+	out := new(big.Float).SetPrec(wp).SetInt64(1)
+	sq := new(big.Float).SetPrec(wp).Set(a)
+	e := new(big.Int).Abs(n)
+	for i := 0; i < e.BitLen(); i++ {
+		if e.Bit(i) == 1 {
+			out.Mul(out, sq)
+		}
+		sq.Mul(sq, sq)
+	}
+	if n.Sign() < 0 {
+		out.Quo(new(big.Float).SetPrec(wp).SetInt64(1), out)
+	}
+	return out.SetPrec(prec), nil
+}
+
+/*bigExp reduces x to r = x/2^k so that |r| < 2^-8, sums the
+taylor series of exp(r) and squares the result k times
+*/
+func bigExp(x *big.Float, prec uint) (*big.Float, error) {
+	k := x.MantExp(nil) + 8
+	if k > 40 {
+		return nil, errors.New("Overflow")
+	}
+	if k < 0 {
+		k = 0
+	}
+	r := new(big.Float).SetPrec(prec).SetMantExp(x, -k)
+	sum := new(big.Float).SetPrec(prec).SetInt64(1)
+	term := new(big.Float).SetPrec(prec).SetInt64(1)
+	for i := int64(1); ; i++ {
+		term.Mul(term, r)
+		term.Quo(term, new(big.Float).SetInt64(i))
+		if term.Sign() == 0 || term.MantExp(nil) < sum.MantExp(nil)-int(prec) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	for ; k > 0; k-- {
+		sum.Mul(sum, sum)
+	}
+	return sum, nil
+}
+
+/*bigLn writes x as m * 2^e with 0.5 <= m < 1, so ln(x) = ln(m) + e*ln(2)
+and both logarithms come from the same atanh series
+*/
+func bigLn(x *big.Float, prec uint) *big.Float {
+	m := new(big.Float).SetPrec(prec)
+	e := x.MantExp(m)
+	out := lnSeries(m, prec)
+	if e != 0 {
+		ln2 := lnSeries(new(big.Float).SetPrec(prec).SetInt64(2), prec)
+		ln2.Mul(ln2, new(big.Float).SetInt64(int64(e)))
+		out.Add(out, ln2)
+	}
+	return out
+}
+
+/*lnSeries is ln(m) = 2 * (z + z^3/3 + z^5/5 + ...) with z = (m-1)/(m+1),
+it converges fast enough for m close to 1
+*/
+func lnSeries(m *big.Float, prec uint) *big.Float {
+	one := new(big.Float).SetPrec(prec).SetInt64(1)
+	z := new(big.Float).SetPrec(prec).Sub(m, one)
+	z.Quo(z, new(big.Float).SetPrec(prec).Add(m, one))
+	z2 := new(big.Float).SetPrec(prec).Mul(z, z)
+
+	sum := new(big.Float).SetPrec(prec).Set(z)
+	pow := new(big.Float).SetPrec(prec).Set(z)
+	term := new(big.Float).SetPrec(prec)
+	for i := int64(3); sum.Sign() != 0; i += 2 {
+		pow.Mul(pow, z2)
+		term.Quo(pow, new(big.Float).SetInt64(i))
+		if term.Sign() == 0 || term.MantExp(nil) < sum.MantExp(nil)-int(prec) {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	return sum.Mul(sum, new(big.Float).SetInt64(2))
+}
@@ -0,0 +1,164 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+)
+
+/*bitOps are the binary operators that only work on integers,
+like "%" the operands are truncated before the operation
+*/
+var bitOps = map[string]bool{
+	"&":   true,
+	"|":   true,
+	"xor": true,
+	"<<":  true,
+	">>":  true,
+}
+
+/*intLiteral parses numbers with a base prefix, the sign comes before
+the prefix, so "-0x10" is -16. Plain decimal numbers return false
+*/
+func intLiteral(s string) (*big.Int, bool) {
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) < 2 || digits[0] != '0' || !strings.ContainsRune("xbo", rune(digits[1])) {
+		return nil, false
+	}
+	return new(big.Int).SetString(s, 0)
+}
+
+/*floatToInt truncates like int(a), but values that don't
+fit in 64 bits are an error instead of garbage
+*/
+func floatToInt(a float64) (int64, error) {
+	if math.IsNaN(a) || a >= math.MaxInt64 || a < math.MinInt64 {
+		return 0, errors.New("Value out of range for a bitwise operation, use exact mode for big integers")
+	}
+	return int64(a), nil
+}
+
+func floatBitOp(op string, a, b float64) (Value, error) {
+	out, err := bitOpcode(binaryOpcodes[op], a, b)
+	if err != nil {
+		return nil, err
+	}
+	return Float(out), nil
+}
+
+/*bitOpcode works on 64 bit integers, so "<<" wraps around
+when the result doesn't fit, exact mode doesn't have that limit
+*/
+func bitOpcode(op Opcode, a, b float64) (float64, error) {
+	x, err := floatToInt(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := floatToInt(b)
+	if err != nil {
+		return 0, err
+	}
+	switch op {
+	case OpAnd:
+		return float64(x & y), nil
+	case OpOr:
+		return float64(x | y), nil
+	case OpXor:
+		return float64(x ^ y), nil
+	case OpShl, OpShr:
+		if y < 0 {
+			return 0, errors.New("Negative shift count")
+		}
+		if op == OpShl {
+			return float64(x << uint64(y)), nil
+		}
+		return float64(x >> uint64(y)), nil
+	}
+	return 0, errors.New("Invalid operation: " + op.String())
+}
+
+func floatNot(a float64) (Value, error) {
+	x, err := floatToInt(a)
+	if err != nil {
+		return nil, err
+	}
+	return Float(^x), nil
+}
+
+func intBitOp(op string, a, b *big.Int) (*big.Int, error) {
+	switch op {
+	case "&":
+		return new(big.Int).And(a, b), nil
+	case "|":
+		return new(big.Int).Or(a, b), nil
+	case "xor":
+		return new(big.Int).Xor(a, b), nil
+	case "<<", ">>":
+		if b.Sign() < 0 {
+			return nil, errors.New("Negative shift count")
+		}
+		if op == ">>" {
+			if b.Cmp(big.NewInt(int64(a.BitLen()))) > 0 { // every bit was shifted out
+				return new(big.Int).Rsh(a, uint(a.BitLen())), nil
+			}
+			return new(big.Int).Rsh(a, uint(b.Int64())), nil
+		}
+		if !b.IsInt64() || int64(a.BitLen())+b.Int64() > maxBits {
+			if a.Sign() != 0 {
+				return nil, errors.New("Shift too large")
+			}
+			return new(big.Int), nil
+		}
+		return new(big.Int).Lsh(a, uint(b.Int64())), nil
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+/*basePrefix is the prefix FormatBase writes for each base, the
+same ones the lexer reads, so results can be pasted back as input
+*/
+var basePrefix = map[int]string{
+	2:  "0b",
+	8:  "0o",
+	10: "",
+	16: "0x",
+}
+
+/*FormatBase writes integer results in base 2, 8, 10 or 16,
+values that are not integers or that have units are an error.
+Booleans are written as they are
+*/
+func FormatBase(v Value, base int) (string, error) {
+	prefix, ok := basePrefix[base]
+	if !ok {
+		return "", errors.New("Unsupported base")
+	}
+	var n *big.Int
+	switch v := v.(type) {
+	case Bool:
+		return v.String(), nil
+	case Float:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) || math.Trunc(f) != f {
+			return "", errors.New("Not an integer: " + v.String())
+		}
+		n, _ = big.NewFloat(f).Int(nil)
+	case Rat:
+		if !v.IsInt() {
+			return "", errors.New("Not an integer: " + v.String())
+		}
+		n = v.Num()
+	case BigFloat:
+		if !v.IsInt() {
+			return "", errors.New("Not an integer: " + v.String())
+		}
+		n, _ = v.Int(nil)
+	default:
+		return "", errors.New("Not an integer: " + v.String())
+	}
+	if n.Sign() < 0 {
+		return "-" + prefix + new(big.Int).Neg(n).Text(base), nil
+	}
+	return prefix + n.Text(base), nil
+}
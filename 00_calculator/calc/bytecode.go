@@ -0,0 +1,362 @@
+package calc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type Opcode uint8
+
+const (
+	OpConst Opcode = iota // push consts[arg]
+	OpVar                 // push the variable in slot arg
+	OpCall                // pop the arguments of calls[arg] and push the result
+	OpNeg
+	OpNot
+	OpFact
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpPow
+	OpAnd
+	OpOr
+	OpXor
+	OpShl
+	OpShr
+)
+
+var opcodeNames = [...]string{
+	OpConst: "CONST",
+	OpVar:   "VAR",
+	OpCall:  "CALL",
+	OpNeg:   "NEG",
+	OpNot:   "NOT",
+	OpFact:  "FACT",
+	OpAdd:   "ADD",
+	OpSub:   "SUB",
+	OpMul:   "MUL",
+	OpDiv:   "DIV",
+	OpMod:   "MOD",
+	OpPow:   "POW",
+	OpAnd:   "AND",
+	OpOr:    "OR",
+	OpXor:   "XOR",
+	OpShl:   "SHL",
+	OpShr:   "SHR",
+}
+
+func (op Opcode) String() string {
+	return opcodeNames[op]
+}
+
+var binaryOpcodes = map[string]Opcode{
+	"+":   OpAdd,
+	"-":   OpSub,
+	"*":   OpMul,
+	"/":   OpDiv,
+	"%":   OpMod,
+	"^":   OpPow,
+	"&":   OpAnd,
+	"|":   OpOr,
+	"xor": OpXor,
+	"<<":  OpShl,
+	">>":  OpShr,
+}
+
+var unaryOpcodes = map[string]Opcode{
+	"-": OpNeg,
+	"~": OpNot,
+	"!": OpFact,
+}
+
+type instr struct {
+	op  Opcode
+	arg uint16
+}
+
+type callSite struct {
+	fn   *Func
+	argc int
+}
+
+/*Program is an expression compiled to a stack machine, it's evaluated
+with float64 only. Where the default mode of the evaluator would give a
+complex number, like "(-8)^(1/3)" or "sqrt(x)" with a negative x, Eval
+returns an error instead. The operands
+of an instruction are indexes into consts, vars or calls, and nodes
+keeps the node that generated each instruction, to report errors
+*/
+type Program struct {
+	code   []instr
+	nodes  []*Node
+	consts []float64
+	calls  []callSite
+	vars   []string
+	depth  int // maximum size of the stack
+}
+
+/*Compile translates the tree in post-order, each operator comes after
+it's operands. Constants and functions are resolved here, variables
+are resolved at each Eval. Units, conversions, assignments, booleans
+and the imaginary unit can't be compiled
+*/
+func Compile(n *Node) (prog *Program, err error) {
+	prog = &Program{}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			prog, err = nil, e
+		}
+	}()
+	prog.compile(n, 0)
+	if len(prog.consts) > math.MaxUint16 || len(prog.vars) > math.MaxUint16 || len(prog.calls) > math.MaxUint16 {
+		return nil, evalError(n, "Expression too big to compile")
+	}
+	return prog, nil
+}
+
+func CompileStr(s string) (*Program, error) {
+	root, err := ParseStr(s)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(root)
+}
+
+/*compile panics with an *Error like the parser, height is the size
+of the stack before the node is evaluated
+*/
+func (p *Program) compile(n *Node, height int) {
+	switch n.tp {
+	case Tnum:
+		v, err := StrToFloat(n.val)
+		if err != nil {
+			panic(evalError(n, "%v", err))
+		}
+		p.emit(n, OpConst, p.constant(v), height+1)
+		return
+	case Tid:
+		if v, ok := Consts[n.val]; ok {
+			p.emit(n, OpConst, p.constant(v), height+1)
+			return
+		}
+		if _, ok := Bools[n.val]; ok {
+			panic(evalError(n, "Can't compile %v, programs only work with numbers", n.val))
+		}
+		if n.val == "i" {
+			panic(evalError(n, "Can't compile i, programs only work with real numbers"))
+		}
+		p.emit(n, OpVar, p.variable(n.val), height+1)
+		return
+	case Tcall:
+		fn, ok := Funcs[n.val]
+		if !ok {
+			panic(evalError(n, "Undefined function: %v", n.val))
+		}
+		if !fn.CheckArity(len(n.kids)) {
+			if fn.Arity == Variadic {
+				panic(evalError(n, "%v expects at least 1 argument", n.val))
+			}
+			panic(evalError(n, "%v expects %v argument(s), got %v", n.val, fn.Arity, len(n.kids)))
+		}
+		for i, kid := range n.kids {
+			p.compile(kid, height+i)
+		}
+		p.calls = append(p.calls, callSite{fn: fn, argc: len(n.kids)})
+		p.emit(n, OpCall, len(p.calls)-1, height+1)
+		return
+	case Tunit:
+		panic(evalError(n, "Units can't be compiled"))
+	}
+	if n.tp == Tnot || isLogic(n) || cmpOps[n.val] {
+		panic(evalError(n, "Can't compile %v, programs only work with numbers", n.val))
+	}
+	if len(n.kids) == 1 {
+		op, ok := unaryOpcodes[n.val]
+		if !ok {
+			panic(evalError(n, "Invalid operation: %v", n.val))
+		}
+		p.compile(n.kids[0], height)
+		p.emit(n, op, 0, height+1)
+		return
+	}
+	op, ok := binaryOpcodes[n.val]
+	if !ok {
+		panic(evalError(n, "Can't compile %v", n.val))
+	}
+	p.compile(n.kids[0], height)
+	for _, kid := range n.kids[1:] {
+		p.compile(kid, height+1)
+		p.emit(n, op, 0, height+1)
+	}
+}
+
+/*emit appends the instruction, height is the size
+of the stack after it's executed
+*/
+func (p *Program) emit(n *Node, op Opcode, arg int, height int) {
+	p.code = append(p.code, instr{op: op, arg: uint16(arg)})
+	p.nodes = append(p.nodes, n)
+	if height > p.depth {
+		p.depth = height
+	}
+}
+
+func (p *Program) constant(v float64) int {
+	for i, c := range p.consts {
+		if c == v && math.Signbit(c) == math.Signbit(v) {
+			return i
+		}
+	}
+	p.consts = append(p.consts, v)
+	return len(p.consts) - 1
+}
+
+func (p *Program) variable(name string) int {
+	for i, v := range p.vars {
+		if v == name {
+			return i
+		}
+	}
+	p.vars = append(p.vars, name)
+	return len(p.vars) - 1
+}
+
+/*Vars are the names of the variables used by the program
+ */
+func (p *Program) Vars() []string {
+	return append([]string(nil), p.vars...)
+}
+
+/*Eval runs the program with the given variables,
+errors are of type *Error, like the ones of solve
+*/
+func (p *Program) Eval(vars map[string]float64) (float64, error) {
+	slots := make([]float64, len(p.vars))
+	for i, name := range p.vars {
+		v, ok := vars[name]
+		if !ok {
+			return 0, evalError(p.varNode(i), "Undefined variable: %v", name)
+		}
+		slots[i] = v
+	}
+	stack := make([]float64, p.depth)
+	sp := 0 // stack[sp-1] is the top
+	for pc, in := range p.code {
+		switch in.op {
+		case OpConst:
+			stack[sp] = p.consts[in.arg]
+			sp++
+			continue
+		case OpVar:
+			stack[sp] = slots[in.arg]
+			sp++
+			continue
+		case OpCall:
+			c := p.calls[in.arg]
+			sp -= c.argc
+			args := stack[sp : sp+c.argc]
+			out := c.fn.Fn(args...)
+			if math.IsNaN(out) && c.fn.Complex != nil && !anyNaN(args) {
+				return 0, evalError(p.nodes[pc], "%v", errComplex)
+			}
+			stack[sp] = out
+			sp++
+			continue
+		case OpNeg:
+			stack[sp-1] = -stack[sp-1]
+			continue
+		case OpNot:
+			x, err := floatToInt(stack[sp-1])
+			if err != nil {
+				return 0, evalError(p.nodes[pc], "%v", err)
+			}
+			stack[sp-1] = float64(^x)
+			continue
+		case OpFact:
+			stack[sp-1] = factorial(int(stack[sp-1]))
+			continue
+		}
+		sp--
+		a, b := stack[sp-1], stack[sp]
+		var out float64
+		switch in.op {
+		case OpAdd:
+			out = a + b
+		case OpSub:
+			out = a - b
+		case OpMul:
+			out = a * b
+		case OpDiv:
+			out = a / b
+		case OpPow:
+			if negPow(a, b) {
+				return 0, evalError(p.nodes[pc], "%v", errComplex)
+			}
+			out = math.Pow(a, b)
+		case OpMod:
+			if int(b) == 0 {
+				return 0, evalError(p.nodes[pc], "Integer division by zero")
+			}
+			out = float64(int(a) % int(b))
+		default:
+			var err error
+			out, err = bitOpcode(in.op, a, b)
+			if err != nil {
+				return 0, evalError(p.nodes[pc], "%v", err)
+			}
+		}
+		stack[sp-1] = out
+	}
+	if sp != 1 {
+		return 0, errors.New("Invalid program")
+	}
+	return stack[0], nil
+}
+
+/*errComplex is returned where solve would promote the result to a complex number*/
+var errComplex = errors.New("The result is complex, programs only work with real numbers")
+
+func anyNaN(xs []float64) bool {
+	for _, x := range xs {
+		if math.IsNaN(x) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Program) varNode(slot int) *Node {
+	for pc, in := range p.code {
+		if in.op == OpVar && int(in.arg) == slot {
+			return p.nodes[pc]
+		}
+	}
+	return nil
+}
+
+/*String disassembles the program, one instruction per line
+ */
+func (p *Program) String() string {
+	var b strings.Builder
+	for pc, in := range p.code {
+		fmt.Fprintf(&b, "%3d %v", pc, in.op)
+		switch in.op {
+		case OpConst:
+			fmt.Fprintf(&b, " %v", p.consts[in.arg])
+		case OpVar:
+			fmt.Fprintf(&b, " %v", p.vars[in.arg])
+		case OpCall:
+			fmt.Fprintf(&b, " %v/%v", p.nodes[pc].val, p.calls[in.arg].argc)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,118 @@
+package calc
+
+import (
+	"math"
+	"testing"
+)
+
+var programTests = []string{
+	"1 + 2 * 3",
+	"x ^ 2 + 3 * x * y - sqrt(y) / (1 + x)",
+	"-(x - y) * -2 % 3",
+	"max(x, y, 3) + min(x, 1) - log(y, 2)",
+	"2 ^ 3 ^ 2 - x!",
+	"(x << 3) | 5 xor ~y & 0xff",
+	"pi * x ^ 2 + e",
+}
+
+func TestProgramEval(t *testing.T) {
+	vars := map[string]float64{"x": 3, "y": 4.5}
+	env := NewEnv()
+	for name, v := range vars {
+		env.Vars[name] = Float(v)
+	}
+	for _, tst := range programTests {
+		t.Run(tst, func(t *testing.T) {
+			want, err := Run(tst, env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prog, err := CompileStr(tst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := prog.Eval(vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w := toFloat(want); got != w && !(math.IsNaN(got) && math.IsNaN(w)) {
+				t.Errorf("got %v, wanted %v\n%v", got, w, prog)
+			}
+		})
+	}
+}
+
+func TestProgramErrors(t *testing.T) {
+	for _, tst := range []string{"x = 1", "3 m", "1 in m", "foo(1)", "sqrt(1, 2)", "!x", "x < 1 ? 1 : 2", "i", "2 * i", "true", "false + 1"} {
+		if _, err := CompileStr(tst); err == nil {
+			t.Errorf("%v: expected a compile error", tst)
+		}
+	}
+	prog, err := CompileStr("x % y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prog.Eval(map[string]float64{"x": 1}); err == nil {
+		t.Error("expected an undefined variable error")
+	}
+	if _, err := prog.Eval(map[string]float64{"x": 1, "y": 0}); err == nil {
+		t.Error("expected a division by zero error")
+	}
+}
+
+/*TestProgramComplex checks that programs fail where solve
+gives a complex number, instead of returning NaN
+*/
+func TestProgramComplex(t *testing.T) {
+	vars := map[string]float64{"x": -4}
+	env := NewEnv()
+	env.Vars["x"] = Float(-4)
+	for _, tst := range []string{"(-8) ^ (1/3)", "sqrt(x)", "x ^ 0.5 + 1", "acos(2)"} {
+		want, err := Run(tst, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := want.(Complex); !ok {
+			t.Fatalf("%v: expected a complex result from solve, got %v", tst, want)
+		}
+		prog, err := CompileStr(tst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := prog.Eval(vars); err == nil {
+			t.Errorf("%v: got %v, expected an error like solve's %v", tst, got, want)
+		}
+	}
+}
+
+const benchExpr = "x ^ 2 + 3 * x * y - sqrt(y) / (1 + x)"
+
+func BenchmarkSolve(b *testing.B) {
+	root, err := ParseStr(benchExpr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	env := NewEnv()
+	for i := 0; i < b.N; i++ {
+		env.Vars["x"] = Float(i)
+		env.Vars["y"] = Float(i / 2)
+		if _, err := solve(root, env); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProgram(b *testing.B) {
+	prog, err := CompileStr(benchExpr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := map[string]float64{}
+	for i := 0; i < b.N; i++ {
+		vars["x"] = float64(i)
+		vars["y"] = float64(i / 2)
+		if _, err := prog.Eval(vars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+/*Complex is always complex128, even in exact mode. Results
+without imaginary part are demoted back to Float, see complexValue
+*/
+type Complex complex128
+
+func (c Complex) String() string {
+	re, im := real(c), imag(c)
+	if im == 0 {
+		return strconv.FormatFloat(re, 'g', -1, 64)
+	}
+	out := ""
+	if re != 0 {
+		out = strconv.FormatFloat(re, 'g', -1, 64)
+		if im >= 0 || math.IsNaN(im) {
+			out += "+"
+		}
+	}
+	switch im {
+	case 1:
+		return out + "i"
+	case -1:
+		return out + "-i"
+	}
+	return out + strconv.FormatFloat(im, 'g', -1, 64) + "i"
+}
+
+/*imaginary parses literals like "3i", the sign comes before the
+number, so "-2.5i" is -2.5i
+*/
+func imaginary(s string) (Value, bool, error) {
+	if !strings.HasSuffix(s, "i") {
+		return nil, false, nil
+	}
+	im, err := StrToFloat(strings.TrimSuffix(s, "i"))
+	if err != nil {
+		return nil, true, errors.New("Invalid number: " + s)
+	}
+	return Complex(complex(0, im)), true, nil
+}
+
+func toComplex(v Value) complex128 {
+	if c, ok := v.(Complex); ok {
+		return complex128(c)
+	}
+	return complex(toFloat(v), 0)
+}
+
+/*complexValue demotes results without imaginary part, so i*i is -1
+and can be used where only real numbers are allowed
+*/
+func complexValue(z complex128) Value {
+	if imag(z) == 0 {
+		return Float(real(z))
+	}
+	return Complex(z)
+}
+
+func complexOp(op string, a, b complex128) (Value, error) {
+	switch op {
+	case "+":
+		return complexValue(a + b), nil
+	case "-":
+		return complexValue(a - b), nil
+	case "*":
+		return complexValue(a * b), nil
+	case "/":
+		return complexValue(a / b), nil
+	case "^":
+		return complexValue(cmplx.Pow(a, b)), nil
+	case "==":
+		return Bool(a == b), nil
+	case "!=":
+		return Bool(a != b), nil
+	case "<", "<=", ">", ">=":
+		return nil, errors.New("Complex numbers can't be ordered: " + Complex(a).String() + " " + op + " " + Complex(b).String())
+	}
+	return nil, errors.New(op + " is only defined for real numbers, got " + Complex(a).String() + " and " + Complex(b).String())
+}
+
+func complexUnary(op string, a complex128) (Value, error) {
+	if op == "-" {
+		return Complex(-a), nil
+	}
+	return nil, errors.New(op + " is only defined for real numbers, got " + Complex(a).String())
+}
+
+/*negPow is a^b for a negative base and a fractional
+exponent, which has no real result
+*/
+func negPow(a, b float64) bool {
+	return a < 0 && !math.IsInf(b, 0) && math.Trunc(b) != b
+}
+
+/*notReal is used where a boolean or a complex
+number would silently become NaN
+*/
+func notReal(n *Node, v Value) error {
+	if _, ok := v.(Complex); ok {
+		return evalError(n, "Expected a real number, got %v", v)
+	}
+	return notBool(n, v)
+}
+
+/*callComplex is used by call when the arguments are complex, or when
+the real function returned NaN for arguments that aren't NaN
+*/
+func callComplex(n *Node, fn *Func, args []Value) (Value, error) {
+	if fn.Complex == nil {
+		for i, a := range args {
+			if _, ok := a.(Complex); ok {
+				return nil, evalError(n.kids[i], "%v is only defined for real numbers, got %v", n.val, a)
+			}
+		}
+		return Float(math.NaN()), nil
+	}
+	z := make([]complex128, len(args))
+	for i, a := range args {
+		z[i] = toComplex(a)
+	}
+	return complexValue(fn.Complex(z...)), nil
+}
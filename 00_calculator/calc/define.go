@@ -0,0 +1,72 @@
+package calc
+
+import (
+	"errors"
+	"strings"
+)
+
+/*UserFunc is a function defined in the session, like "f(x, y) = x^2 + y".
+The body only sees the parameters and the variables of the session,
+never the parameters of the function that called it
+*/
+type UserFunc struct {
+	Name   string
+	Params []string
+	Body   *Node
+}
+
+/*String is the definition, so defining a function
+prints the function back
+*/
+func (f *UserFunc) String() string {
+	return f.Name + "(" + strings.Join(f.Params, ", ") + ") = " + Format(f.Body)
+}
+
+func define(n *Node, env *Env) (Value, error) {
+	head := n.kids[0]
+	if _, ok := Funcs[head.val]; ok {
+		return nil, evalError(head, "Cannot redefine builtin function: %v", head.val)
+	}
+	f := &UserFunc{Name: head.val, Body: n.kids[1]}
+	for _, param := range head.kids {
+		for _, p := range f.Params {
+			if p == param.val {
+				return nil, evalError(param, "Duplicate parameter: %v", p)
+			}
+		}
+		f.Params = append(f.Params, param.val)
+	}
+	env.Funcs[f.Name] = f
+	return f, nil
+}
+
+/*callUser evaluates the arguments in the environment of the caller, then
+the body in a copy of it that binds the parameters, the copy shares the
+variables and functions of the session
+*/
+func callUser(n *Node, f *UserFunc, env *Env) (Value, error) {
+	if len(n.kids) != len(f.Params) {
+		return nil, evalError(n, "%v expects %v argument(s), got %v", n.val, len(f.Params), len(n.kids))
+	}
+	if env.depth >= env.MaxDepth {
+		return nil, evalError(n, "Maximum recursion depth exceeded: %v", env.MaxDepth)
+	}
+	locals := make(map[string]Value, len(f.Params))
+	for i, kid := range n.kids {
+		a, err := solve(kid, env)
+		if err != nil {
+			return nil, err
+		}
+		locals[f.Params[i]] = a
+	}
+	inner := *env
+	inner.locals = locals
+	inner.depth++
+	out, err := solve(f.Body, &inner)
+	var e *Error
+	if err != nil && env.depth == 0 && errors.As(err, &e) {
+		// the span of e is in the definition, not in what's being evaluated
+		return nil, evalError(n, "In %v: %v", f.Name, e.Msg)
+	}
+	return out, err
+}
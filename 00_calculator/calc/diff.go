@@ -0,0 +1,178 @@
+package calc
+
+/*Diff returns the derivative of the expression with respect to the variable x,
+the result is not simplified, see Simplify
+*/
+func Diff(n *Node, x string) (*Node, error) {
+	switch n.tp {
+	case Tnum:
+		return numNode("0"), nil
+	case Tid:
+		if n.val == x {
+			return numNode("1"), nil
+		}
+		return numNode("0"), nil
+	case Tcall:
+		return diffCall(n, x)
+	}
+	if !dependsOn(n, x) {
+		return numNode("0"), nil
+	}
+	if len(n.kids) == 1 {
+		if n.val != "-" {
+			return nil, evalError(n, "Cannot differentiate %v", n.val)
+		}
+		da, err := Diff(n.kids[0], x)
+		if err != nil {
+			return nil, err
+		}
+		return opNode("-", da), nil
+	}
+	if n.val == "?" { // differentiates each branch, the condition is kept
+		da, err := Diff(n.kids[1], x)
+		if err != nil {
+			return nil, err
+		}
+		db, err := Diff(n.kids[2], x)
+		if err != nil {
+			return nil, err
+		}
+		return opNode("?", n.kids[0], da, db), nil
+	}
+	a, b := n.kids[0], n.kids[1]
+	da, err := Diff(a, x)
+	if err != nil {
+		return nil, err
+	}
+	db, err := Diff(b, x)
+	if err != nil {
+		return nil, err
+	}
+	switch n.val {
+	case "+", "-":
+		return opNode(n.val, da, db), nil
+	case "*": // product rule
+		return opNode("+", opNode("*", da, b), opNode("*", a, db)), nil
+	case "/": // quotient rule
+		if !dependsOn(b, x) {
+			return opNode("/", da, b), nil
+		}
+		num := opNode("-", opNode("*", da, b), opNode("*", a, db))
+		return opNode("/", num, opNode("^", b, numNode("2"))), nil
+	case "^":
+		return diffPow(a, b, da, db, x), nil
+	}
+	return nil, evalError(n, "Cannot differentiate %v", n.val)
+}
+
+/*diffPow uses the power rule when the exponent is constant,
+otherwise a^b is differentiated as exp(b * ln(a))
+*/
+func diffPow(a, b, da, db *Node, x string) *Node {
+	pow := opNode("^", a, b)
+	if !dependsOn(b, x) { // b * a^(b-1) * a'
+		return opNode("*", opNode("*", b, opNode("^", a, opNode("-", b, numNode("1")))), da)
+	}
+	if !dependsOn(a, x) { // a^b * ln(a) * b'
+		return opNode("*", opNode("*", pow, callNode("ln", a)), db)
+	}
+	// a^b * (b' * ln(a) + b * a' / a)
+	inner := opNode("+", opNode("*", db, callNode("ln", a)), opNode("/", opNode("*", b, da), a))
+	return opNode("*", pow, inner)
+}
+
+/*derivatives gives the derivative of each builtin with respect to it's
+argument u, the chain rule multiplies it by u'. Functions that are not
+here can't be differentiated
+*/
+var derivatives = map[string]func(u *Node) *Node{
+	"sqrt": func(u *Node) *Node {
+		return opNode("/", numNode("1"), opNode("*", numNode("2"), callNode("sqrt", u)))
+	},
+	"sin": func(u *Node) *Node {
+		return callNode("cos", u)
+	},
+	"cos": func(u *Node) *Node {
+		return opNode("-", callNode("sin", u))
+	},
+	"tan": func(u *Node) *Node {
+		return opNode("/", numNode("1"), opNode("^", callNode("cos", u), numNode("2")))
+	},
+	"asin": func(u *Node) *Node {
+		return opNode("/", numNode("1"), callNode("sqrt", opNode("-", numNode("1"), opNode("^", u, numNode("2")))))
+	},
+	"acos": func(u *Node) *Node {
+		return opNode("/", numNode("-1"), callNode("sqrt", opNode("-", numNode("1"), opNode("^", u, numNode("2")))))
+	},
+	"atan": func(u *Node) *Node {
+		return opNode("/", numNode("1"), opNode("+", numNode("1"), opNode("^", u, numNode("2"))))
+	},
+	"exp": func(u *Node) *Node {
+		return callNode("exp", u)
+	},
+	"ln": func(u *Node) *Node {
+		return opNode("/", numNode("1"), u)
+	},
+	"abs": func(u *Node) *Node {
+		return opNode("/", u, callNode("abs", u))
+	},
+}
+
+func diffCall(n *Node, x string) (*Node, error) {
+	if !dependsOn(n, x) {
+		return numNode("0"), nil
+	}
+	if n.val == "log" && len(n.kids) == 2 { // log(u, b) = ln(u) / ln(b)
+		return Diff(opNode("/", callNode("ln", n.kids[0]), callNode("ln", n.kids[1])), x)
+	}
+	d, ok := derivatives[n.val]
+	if !ok {
+		return nil, evalError(n, "Cannot differentiate %v", n.val)
+	}
+	if len(n.kids) != 1 {
+		return nil, evalError(n, "%v expects 1 argument(s), got %v", n.val, len(n.kids))
+	}
+	u := n.kids[0]
+	du, err := Diff(u, x)
+	if err != nil {
+		return nil, err
+	}
+	return opNode("*", d(u), du), nil
+}
+
+func dependsOn(n *Node, x string) bool {
+	if n.tp == Tid {
+		return n.val == x
+	}
+	for _, kid := range n.kids {
+		if dependsOn(kid, x) {
+			return true
+		}
+	}
+	return false
+}
+
+func callNode(name string, args ...*Node) *Node {
+	n := newNode(&Token{val: name, tp: Tcall})
+	for _, arg := range args {
+		n.newLeaf(arg)
+	}
+	return n
+}
+
+/*DiffStr parses s and returns the simplified derivative with respect to x
+ */
+func DiffStr(s, x string, env *Env) (*Node, error) {
+	root, err := ParseStr(s)
+	if err != nil {
+		return nil, err
+	}
+	if root.val == "=" && root.tp == Tope {
+		return nil, evalError(root, "Cannot differentiate an assignment")
+	}
+	d, err := Diff(root, x)
+	if err != nil {
+		return nil, err
+	}
+	return Simplify(d, env), nil
+}
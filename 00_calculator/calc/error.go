@@ -0,0 +1,131 @@
+package calc
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type ErrorKind int
+
+const (
+	LexErr ErrorKind = iota
+	SyntaxErr
+	EvalErr
+)
+
+var kindMap = map[ErrorKind]string{
+	LexErr:    "Lexical error",
+	SyntaxErr: "Invalid Syntax",
+	EvalErr:   "Evaluation error",
+}
+
+/*Pos is a place in the input, Line and Col start at 1
+and Col counts runes, not bytes
+*/
+type Pos struct {
+	Offset    int
+	Line, Col int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%v:%v", p.Line, p.Col)
+}
+
+/*Span goes from Start up to, but not including, End
+ */
+type Span struct {
+	Start, End Pos
+}
+
+/*join returns the smallest span containing both spans
+ */
+func (s Span) join(o Span) Span {
+	if o.Start.Offset < s.Start.Offset {
+		s.Start = o.Start
+	}
+	if o.End.Offset > s.End.Offset {
+		s.End = o.End
+	}
+	return s
+}
+
+/*Error is returned by Lex, Parse and Eval. Offset is the byte
+offset of Token in the original expression, Span covers the whole
+offending piece of it. Syntax errors list what the grammar
+rule being parsed would accept in Expected
+*/
+type Error struct {
+	Kind     ErrorKind
+	Offset   int
+	Span     Span
+	Token    string
+	Msg      string
+	Expected []string
+}
+
+func (e *Error) Error() string {
+	out := fmt.Sprintf("%v: %v at: '%v'", e.Span.Start, kindMap[e.Kind], e.Token)
+	if e.Msg != "" {
+		out += ". " + e.Msg
+	}
+	if len(e.Expected) == 1 {
+		out += ". Expected " + e.Expected[0]
+	} else if len(e.Expected) > 1 {
+		out += ". Expected one of: " + strings.Join(e.Expected, ", ")
+	}
+	return out
+}
+
+/*Caret returns the message followed by the line of src where
+the error starts, with carets under the offending span
+*/
+func (e *Error) Caret(src string) string {
+	start, end := e.Span.Start.Offset, e.Span.End.Offset
+	if start > len(src) {
+		start = len(src)
+	}
+	lineStart := strings.LastIndex(src[:start], "\n") + 1
+	lineEnd := strings.Index(src[start:], "\n")
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += start
+	}
+	if end > lineEnd { // spans over many lines only mark the first one
+		end = lineEnd
+	}
+	pad := ""
+	for _, r := range src[lineStart:start] {
+		if r == '\t' {
+			pad += "\t"
+		} else {
+			pad += " "
+		}
+	}
+	width := utf8.RuneCountInString(src[start:end])
+	if width == 0 { // EOF
+		width = 1
+	}
+	return e.Error() + "\n" + src[lineStart:lineEnd] + "\n" + pad + strings.Repeat("^", width) + "\n"
+}
+
+func syntaxError(l *Token, expected []string) *Error {
+	return &Error{
+		Kind:     SyntaxErr,
+		Offset:   l.span.Start.Offset,
+		Span:     l.span,
+		Token:    l.String(),
+		Expected: expected,
+	}
+}
+
+func evalError(n *Node, format string, a ...interface{}) *Error {
+	return &Error{
+		Kind:   EvalErr,
+		Offset: n.span.Start.Offset,
+		Span:   n.span,
+		Token:  n.Token.String(),
+		Msg:    fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,186 @@
+package calc
+
+import (
+	"errors"
+	"math/big"
+)
+
+/*maxBits limits the size of exact results of "^" and "!",
+so a typo like 99^99^99 doesn't hang the evaluator
+*/
+const maxBits = 1 << 24
+
+func StrToRat(s string) (Value, error) {
+	if n, ok := intLiteral(s); ok {
+		return Rat{new(big.Rat).SetInt(n)}, nil
+	}
+	out, ok := new(big.Rat).SetString(s)
+	if ok {
+		return Rat{out}, nil
+	}
+	return nil, errors.New("Invalid number: " + s)
+}
+
+func ratOp(op string, a, b *big.Rat, prec uint) (Value, error) {
+	switch op {
+	case "+":
+		return Rat{new(big.Rat).Add(a, b)}, nil
+	case "-":
+		return Rat{new(big.Rat).Sub(a, b)}, nil
+	case "*":
+		return Rat{new(big.Rat).Mul(a, b)}, nil
+	case "/":
+		if b.Sign() == 0 {
+			return nil, errors.New("Division by zero")
+		}
+		return Rat{new(big.Rat).Quo(a, b)}, nil
+	case "%":
+		out, err := intRem(toInt(Rat{a}), toInt(Rat{b}))
+		if err != nil {
+			return nil, err
+		}
+		return Rat{new(big.Rat).SetInt(out)}, nil
+	case "^":
+		if b.IsInt() {
+			return ratPowInt(a, b.Num())
+		}
+		if a.Sign() < 0 {
+			return complexOp(op, toComplex(Rat{a}), toComplex(Rat{b}))
+		}
+		out, err := bigPow(toBigFloat(Rat{a}, prec).Float, toBigFloat(Rat{b}, prec).Float, prec)
+		if err != nil {
+			return nil, err
+		}
+		return BigFloat{out}, nil
+	case "&", "|", "xor", "<<", ">>":
+		out, err := intBitOp(op, toInt(Rat{a}), toInt(Rat{b}))
+		if err != nil {
+			return nil, err
+		}
+		return Rat{new(big.Rat).SetInt(out)}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		return compare(op, a.Cmp(b))
+	default:
+		return nil, errors.New("Invalid operation: " + op)
+	}
+}
+
+func ratUnary(op string, a *big.Rat) (Value, error) {
+	switch op {
+	case "!":
+		out, err := intFactorial(toInt(Rat{a}))
+		if err != nil {
+			return nil, err
+		}
+		return Rat{new(big.Rat).SetInt(out)}, nil
+	case "-":
+		return Rat{new(big.Rat).Neg(a)}, nil
+	case "~":
+		return Rat{new(big.Rat).SetInt(new(big.Int).Not(toInt(Rat{a})))}, nil
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+func bigOp(op string, a, b *big.Float, prec uint) (Value, error) {
+	switch op {
+	case "+":
+		return BigFloat{new(big.Float).Add(a, b)}, nil
+	case "-":
+		return BigFloat{new(big.Float).Sub(a, b)}, nil
+	case "*":
+		return BigFloat{new(big.Float).Mul(a, b)}, nil
+	case "/":
+		if b.Sign() == 0 {
+			return nil, errors.New("Division by zero")
+		}
+		return BigFloat{new(big.Float).Quo(a, b)}, nil
+	case "%":
+		out, err := intRem(toInt(BigFloat{a}), toInt(BigFloat{b}))
+		if err != nil {
+			return nil, err
+		}
+		return BigFloat{new(big.Float).SetPrec(prec).SetInt(out)}, nil
+	case "^":
+		if a.Sign() < 0 && !b.IsInt() {
+			return complexOp(op, toComplex(BigFloat{a}), toComplex(BigFloat{b}))
+		}
+		out, err := bigPow(a, b, prec)
+		if err != nil {
+			return nil, err
+		}
+		return BigFloat{out}, nil
+	case "&", "|", "xor", "<<", ">>":
+		out, err := intBitOp(op, toInt(BigFloat{a}), toInt(BigFloat{b}))
+		if err != nil {
+			return nil, err
+		}
+		return BigFloat{new(big.Float).SetPrec(prec).SetInt(out)}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		return compare(op, a.Cmp(b))
+	default:
+		return nil, errors.New("Invalid operation: " + op)
+	}
+}
+
+func bigUnary(op string, a *big.Float) (Value, error) {
+	switch op {
+	case "!":
+		out, err := intFactorial(toInt(BigFloat{a}))
+		if err != nil {
+			return nil, err
+		}
+		return BigFloat{new(big.Float).SetPrec(a.Prec()).SetInt(out)}, nil
+	case "-":
+		return BigFloat{new(big.Float).Neg(a)}, nil
+	case "~":
+		out := new(big.Int).Not(toInt(BigFloat{a}))
+		return BigFloat{new(big.Float).SetPrec(a.Prec()).SetInt(out)}, nil
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+/*ratPowInt raises numerator and denominator separately,
+a negative exponent swaps them
+*/
+func ratPowInt(a *big.Rat, n *big.Int) (Value, error) {
+	if n.Sign() < 0 && a.Sign() == 0 {
+		return nil, errors.New("Division by zero")
+	}
+	bits := a.Num().BitLen() + a.Denom().BitLen()
+	if n.BitLen() > 32 || int64(bits)*new(big.Int).Abs(n).Int64() > maxBits {
+		if !isUnit(a) {
+			return nil, errors.New("Exponent too large")
+		}
+	}
+	e := new(big.Int).Abs(n)
+	if !n.IsInt64() { // 0, 1 and -1 only care about the parity
+		e.SetInt64(int64(2 + n.Bit(0)))
+	}
+	num := new(big.Int).Exp(a.Num(), e, nil)
+	den := new(big.Int).Exp(a.Denom(), e, nil)
+	if n.Sign() < 0 {
+		num, den = den, num
+	}
+	return Rat{new(big.Rat).SetFrac(num, den)}, nil
+}
+
+func isUnit(a *big.Rat) bool {
+	return a.Sign() == 0 || a.IsInt() && a.Num().CmpAbs(big.NewInt(1)) == 0
+}
+
+func intRem(a, b *big.Int) (*big.Int, error) {
+	if b.Sign() == 0 {
+		return nil, errors.New("Integer division by zero")
+	}
+	return new(big.Int).Rem(a, b), nil
+}
+
+func intFactorial(n *big.Int) (*big.Int, error) {
+	if n.Sign() <= 0 {
+		return big.NewInt(1), nil
+	}
+	if !n.IsInt64() || n.Int64() > maxBits/32 {
+		return nil, errors.New("Factorial too large")
+	}
+	return new(big.Int).MulRange(1, n.Int64()), nil
+}
@@ -0,0 +1,389 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// DefaultPrec is the precision in bits of big.Float results in exact mode
+const DefaultPrec = 128
+
+// DefaultMaxDepth is how many calls of user functions can be nested
+const DefaultMaxDepth = 1000
+
+/*Env holds the variables and functions of a session, assignments
+write to it and identifiers read from it.
+If Exact is set literals are read as big.Rat, Prec is the precision
+used for results that can't be exact, like "^" with fractional exponents.
+If Interval is set literals are read as the smallest Interval around them.
+Inside a user function locals has the parameters, and depth counts the calls
+*/
+type Env struct {
+	Vars     map[string]Value
+	Funcs    map[string]*UserFunc
+	Exact    bool
+	Interval bool
+	Prec     uint
+	MaxDepth int
+
+	locals map[string]Value
+	depth  int
+}
+
+func NewEnv() *Env {
+	return &Env{
+		Vars:     make(map[string]Value),
+		Funcs:    make(map[string]*UserFunc),
+		Prec:     DefaultPrec,
+		MaxDepth: DefaultMaxDepth,
+	}
+}
+
+/*Run lexes, parses and evaluates a single statement
+ */
+func Run(s string, env *Env) (Value, error) {
+	root, err := ParseStr(s)
+	if err != nil {
+		return nil, err
+	}
+	return Eval(root, env)
+}
+
+/*Eval solves the tree, errors are of type *Error
+ */
+func Eval(n *Node, env *Env) (Value, error) {
+	return solve(n, env)
+}
+
+func solve(n *Node, env *Env) (Value, error) {
+	switch n.tp {
+	case Tnum:
+		out, err := env.literal(n.val)
+		if err != nil {
+			return nil, evalError(n, "%v", err)
+		}
+		return out, nil
+	case Tcall:
+		return call(n, env)
+	case Tunit:
+		return solveUnit(n, env)
+	case Tid:
+		if out, ok := env.locals[n.val]; ok {
+			return out, nil
+		}
+		if out, ok := Consts[n.val]; ok {
+			if env.Interval {
+				return intervalOf(out), nil
+			}
+			return Float(out), nil
+		}
+		if out, ok := Bools[n.val]; ok {
+			return out, nil
+		}
+		if out, ok := env.Vars[n.val]; ok {
+			return out, nil
+		}
+		if n.val == "i" { // after the variables, so i can still be used as a variable
+			return Complex(1i), nil
+		}
+		return nil, evalError(n, "Undefined variable: %v", n.val)
+	}
+	if n.val == "=" && n.kids[0].tp == Tcall {
+		return define(n, env)
+	}
+	if n.val == "=" {
+		_, isConst := Consts[n.kids[0].val]
+		_, isBool := Bools[n.kids[0].val]
+		if isConst || isBool {
+			return nil, evalError(n.kids[0], "Cannot assign to constant: %v", n.kids[0].val)
+		}
+		out, err := solve(n.kids[1], env)
+		if err != nil {
+			return nil, err
+		}
+		env.Vars[n.kids[0].val] = out
+		return out, nil
+	}
+	if n.val == "in" {
+		return solveConv(n, env)
+	}
+	if isLogic(n) {
+		return solveLogic(n, env)
+	}
+	if n.val == "[" || n.val == "±" {
+		return solveInterval(n, env)
+	}
+	if len(n.kids) == 1 { // unary
+		a, err := solve(n.kids[0], env)
+		if err != nil {
+			return nil, err
+		}
+		out, err := DoUnary(n.val, a, env.Prec)
+		if err != nil {
+			return nil, evalError(n, "%v", err)
+		}
+		return out, nil
+	}
+	out, err := solve(n.kids[0], env)
+	if err != nil {
+		return nil, err
+	}
+	for _, kid := range n.kids[1:] {
+		b, err := solve(kid, env)
+		if err != nil {
+			return nil, err
+		}
+		out, err = DoOp(n.val, out, b, env.Prec)
+		if err != nil {
+			return nil, evalError(n, "%v", err)
+		}
+	}
+	return out, nil
+}
+
+/*call converts the arguments to float64, so functions
+are never exact, even in exact mode. Complex arguments
+use the complex version of the function, see Func
+*/
+func call(n *Node, env *Env) (Value, error) {
+	fn, ok := Funcs[n.val]
+	if !ok {
+		if user, ok := env.Funcs[n.val]; ok {
+			return callUser(n, user, env)
+		}
+		return nil, evalError(n, "Undefined function: %v", n.val)
+	}
+	if !fn.CheckArity(len(n.kids)) {
+		if fn.Arity == Variadic {
+			return nil, evalError(n, "%v expects at least 1 argument", n.val)
+		}
+		return nil, evalError(n, "%v expects %v argument(s), got %v", n.val, fn.Arity, len(n.kids))
+	}
+	values := make([]Value, len(n.kids))
+	args := make([]float64, len(n.kids))
+	isComplex, hasNaN := false, false
+	for i, kid := range n.kids {
+		a, err := solve(kid, env)
+		if err != nil {
+			return nil, err
+		}
+		if q, ok := a.(Quantity); ok {
+			return nil, evalError(kid, "%v expects numbers without units, got %v", n.val, q.Dim)
+		}
+		if err := notBool(kid, a); err != nil {
+			return nil, err
+		}
+		if _, ok := a.(Complex); ok {
+			isComplex = true
+		}
+		values[i], args[i] = a, toFloat(a)
+		hasNaN = hasNaN || math.IsNaN(args[i])
+	}
+	if env.Interval {
+		return callInterval(n, values)
+	}
+	if isComplex {
+		return callComplex(n, fn, values)
+	}
+	out := fn.Fn(args...)
+	if math.IsNaN(out) && !hasNaN && fn.Complex != nil {
+		return callComplex(n, fn, values)
+	}
+	return Float(out), nil
+}
+
+/*solveUnit evaluates both the unit of a literal, where the first kid
+is the number and the second is the exponent, and units by themselves
+*/
+func solveUnit(n *Node, env *Env) (Value, error) {
+	if env.Interval {
+		return nil, evalError(n, "Units are not supported in interval mode")
+	}
+	exp := 1.0
+	if len(n.kids) == 2 {
+		e, err := solve(n.kids[1], env)
+		if err != nil {
+			return nil, err
+		}
+		if err := notReal(n.kids[1], e); err != nil {
+			return nil, err
+		}
+		exp = toFloat(e)
+	}
+	u, err := unitValue(n.val, exp)
+	if err != nil {
+		return nil, evalError(n, "%v", err)
+	}
+	if len(n.kids) == 0 {
+		return u, nil
+	}
+	num, err := solve(n.kids[0], env)
+	if err != nil {
+		return nil, err
+	}
+	if err := notReal(n.kids[0], num); err != nil {
+		return nil, err
+	}
+	u.V *= toFloat(num)
+	return u, nil
+}
+
+func solveConv(n *Node, env *Env) (Value, error) {
+	if env.Interval {
+		return nil, evalError(n, "Units are not supported in interval mode")
+	}
+	a, err := solve(n.kids[0], env)
+	if err != nil {
+		return nil, err
+	}
+	if err := notReal(n.kids[0], a); err != nil {
+		return nil, err
+	}
+	u, err := solve(n.kids[1], env)
+	if err != nil {
+		return nil, err
+	}
+	out, err := convertUnits(toQuantity(a), toQuantity(u), formatUnit(n.kids[1]))
+	if err != nil {
+		return nil, evalError(n, "%v", err)
+	}
+	return out, nil
+}
+
+func (env *Env) literal(s string) (Value, error) {
+	if out, ok, err := imaginary(s); ok {
+		if env.Interval {
+			return nil, errors.New("Complex numbers are not supported in interval mode")
+		}
+		return out, err
+	}
+	if env.Interval {
+		return StrToInterval(s)
+	}
+	if env.Exact {
+		return StrToRat(s)
+	}
+	out, err := StrToFloat(s)
+	return Float(out), err
+}
+
+func StrToFloat(s string) (float64, error) {
+	if n, ok := intLiteral(s); ok {
+		out, _ := new(big.Float).SetInt(n).Float64()
+		return out, nil
+	}
+	out, ok := strconv.ParseFloat(s, 64)
+	if ok == nil {
+		return out, nil
+	}
+	return 0, errors.New("Invalid number: " + s)
+}
+
+/*DoOp brings both operands to the same kind of number, see rank
+ */
+func DoOp(op string, a, b Value, prec uint) (Value, error) {
+	_, boolA := a.(Bool)
+	_, boolB := b.(Bool)
+	if boolA || boolB {
+		return boolOp(op, a, b)
+	}
+	_, complexA := a.(Complex)
+	_, complexB := b.(Complex)
+	_, unitA := a.(Quantity)
+	_, unitB := b.(Quantity)
+	if complexA && unitB || complexB && unitA {
+		return nil, errors.New("Complex numbers can't have units")
+	}
+	_, intervalA := a.(Interval)
+	_, intervalB := b.(Interval)
+	if (intervalA || intervalB) && (complexA || complexB || unitA || unitB) {
+		return nil, errors.New("Intervals can't be complex or have units")
+	}
+	a, b = promote(a, b, prec)
+	switch a := a.(type) {
+	case Rat:
+		return ratOp(op, a.Rat, b.(Rat).Rat, prec)
+	case BigFloat:
+		return bigOp(op, a.Float, b.(BigFloat).Float, prec)
+	case Quantity:
+		return quantityOp(op, a, b.(Quantity))
+	case Complex:
+		return complexOp(op, complex128(a), toComplex(b))
+	case Interval:
+		return intervalOp(op, a, toInterval(b))
+	}
+	return floatOp(op, toFloat(a), toFloat(b))
+}
+
+func DoUnary(op string, a Value, prec uint) (Value, error) {
+	switch a := a.(type) {
+	case Rat:
+		return ratUnary(op, a.Rat)
+	case BigFloat:
+		return bigUnary(op, a.Float)
+	case Quantity:
+		return quantityUnary(op, a)
+	case Bool:
+		return nil, errors.New("Invalid operation for booleans: " + op)
+	case Complex:
+		return complexUnary(op, complex128(a))
+	case Interval:
+		return intervalUnary(op, a)
+	}
+	return floatUnary(op, toFloat(a))
+}
+
+func floatOp(op string, a, b float64) (Value, error) {
+	switch op {
+	case "+":
+		return Float(a + b), nil
+	case "-":
+		return Float(a - b), nil
+	case "*":
+		return Float(a * b), nil
+	case "/":
+		return Float(a / b), nil
+	case "%":
+		if int(b) == 0 {
+			return nil, errors.New("Integer division by zero")
+		}
+		return Float(int(a) % int(b)), nil
+	case "^":
+		if negPow(a, b) {
+			return complexOp(op, complex(a, 0), complex(b, 0))
+		}
+		return Float(math.Pow(a, b)), nil
+	case "&", "|", "xor", "<<", ">>":
+		return floatBitOp(op, a, b)
+	case "==", "!=", "<", "<=", ">", ">=":
+		return floatCompare(op, a, b)
+	default:
+		return nil, errors.New("Invalid operation: " + op)
+	}
+}
+
+func floatUnary(op string, a float64) (Value, error) {
+	switch op {
+	case "!":
+		return Float(factorial(int(a))), nil
+	case "-":
+		return Float(-a), nil
+	case "~":
+		return floatNot(a)
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+/*factorial is done in float64, so big results become +Inf instead of
+overflowing, use exact mode to get all digits
+*/
+func factorial(a int) float64 {
+	out := 1.0
+	for a > 0 && !math.IsInf(out, 1) {
+		out *= float64(a)
+		a--
+	}
+	return out
+}
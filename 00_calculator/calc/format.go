@@ -0,0 +1,178 @@
+package calc
+
+import "strings"
+
+/*Precedence levels used by Format, they follow the grammar: each level
+is a procedure of the parser and a higher level binds tighter
+*/
+const (
+	precAssign = iota
+	precConv
+	precCond
+	precOr
+	precAnd
+	precNot
+	precCmp
+	precBitOr
+	precBitXor
+	precBitAnd
+	precShift
+	precSum
+	precTol
+	precTerm
+	precPower
+	precUnary  // postfix "!"
+	precSigned // "-x", "~x" and negative numbers
+	precAtom
+)
+
+var precMap = map[string]int{
+	"=":   precAssign,
+	"in":  precConv,
+	"?":   precCond,
+	"||":  precOr,
+	"&&":  precAnd,
+	"==":  precCmp,
+	"!=":  precCmp,
+	"<":   precCmp,
+	"<=":  precCmp,
+	">":   precCmp,
+	">=":  precCmp,
+	"|":   precBitOr,
+	"xor": precBitXor,
+	"&":   precBitAnd,
+	"<<":  precShift,
+	">>":  precShift,
+	"+":   precSum,
+	"-":   precSum,
+	"±":   precTol,
+	"*":   precTerm,
+	"/":   precTerm,
+	"%":   precTerm,
+	"^":   precPower,
+}
+
+var rightAssoc = map[string]bool{
+	"^": true,
+}
+
+// nonAssoc operators need parentheses on both sides
+var nonAssoc = map[string]bool{
+	"==": true,
+	"!=": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+	"±":  true,
+}
+
+/*Format prints the tree back in infix form, with only the parentheses
+needed to parse it into the same tree again
+*/
+func Format(n *Node) string {
+	out, _ := format(n)
+	return out
+}
+
+/*format returns the text and the precedence level of the node,
+the parent decides if it needs parentheses around it
+*/
+func format(n *Node) (string, int) {
+	switch n.tp {
+	case Tnum:
+		if strings.HasPrefix(n.val, "-") || strings.HasPrefix(n.val, "+") {
+			return n.val, precSigned
+		}
+		return n.val, precAtom
+	case Tid:
+		return n.val, precAtom
+	case Tcall:
+		args := make([]string, len(n.kids))
+		for i, kid := range n.kids {
+			args[i], _ = format(kid)
+		}
+		return n.val + "(" + strings.Join(args, ", ") + ")", precAtom
+	case Tunit:
+		if len(n.kids) == 0 {
+			return n.val, precAtom
+		}
+		num, _ := format(n.kids[0])
+		out := num + " " + n.val
+		if len(n.kids) == 2 {
+			out += "^" + operand(n.kids[1], precSigned)
+		}
+		return out, precTerm // "(3 m)^2" is not "3 m^2"
+	}
+	if n.val == "[" && n.tp == Tope {
+		a, _ := format(n.kids[0])
+		b, _ := format(n.kids[1])
+		return "[" + a + ", " + b + "]", precAtom
+	}
+	if n.tp == Tnot {
+		return n.val + operand(n.kids[0], precNot), precNot
+	}
+	if len(n.kids) == 1 {
+		if n.val == "!" {
+			return operand(n.kids[0], precSigned) + "!", precUnary
+		}
+		if n.val == "~" {
+			return n.val + operand(n.kids[0], precSigned), precSigned
+		}
+		return n.val + operand(n.kids[0], precAtom), precSigned
+	}
+	if isCompound(n) {
+		left, _ := format(n.kids[0])
+		return left + n.val + formatUnit(n.kids[1]), precTerm
+	}
+	prec := precMap[n.val]
+	left, right := prec, prec+1
+	if rightAssoc[n.val] {
+		left, right = prec+1, prec
+	}
+	if nonAssoc[n.val] {
+		left = prec + 1
+	}
+	if prec == precAssign { // the left side is always an identifier
+		left = precAtom
+	}
+	if prec == precConv {
+		return operand(n.kids[0], precCond) + " in " + formatUnit(n.kids[1]), prec
+	}
+	if prec == precCond { // the condition can't be another "?"
+		return operand(n.kids[0], precOr) + " ? " + operand(n.kids[1], precCond) + " : " + operand(n.kids[2], precCond), prec
+	}
+	out := operand(n.kids[0], left)
+	for _, kid := range n.kids[1:] {
+		out += " " + n.val + " " + operand(kid, right)
+	}
+	return out, prec
+}
+
+/*operand formats the kid and puts it inside parentheses
+if it binds looser than min
+*/
+func operand(n *Node, min int) string {
+	out, prec := format(n)
+	if prec < min {
+		return "(" + out + ")"
+	}
+	return out
+}
+
+/*isCompound tells if the node is a unit of a number followed by "*" or "/"
+and other units, which are printed without spaces, like "9.8 m/s^2"
+*/
+func isCompound(n *Node) bool {
+	if n.tp != Tope || n.val != "*" && n.val != "/" {
+		return false
+	}
+	unit, right := n.kids[0], n.kids[1]
+	if right.val == "^" {
+		right = right.kids[0]
+	}
+	if right.tp != Tunit || len(right.kids) > 0 {
+		return false
+	}
+	return unit.tp == Tunit && len(unit.kids) > 0 || isCompound(unit)
+}
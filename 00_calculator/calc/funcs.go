@@ -0,0 +1,103 @@
+package calc
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// Variadic is the arity of functions that take one or more arguments
+const Variadic = -1
+
+/*Func is a builtin function, the evaluator checks that calls
+pass exactly Arity arguments before calling Fn. Complex is used when
+an argument is complex, or when Fn returns NaN for real arguments,
+so sqrt(-1) is i. Functions without it only take real numbers
+*/
+type Func struct {
+	Arity   int
+	Fn      func(args ...float64) float64
+	Complex func(args ...complex128) complex128
+}
+
+var Funcs = map[string]*Func{
+	"sqrt":  unary(math.Sqrt, cmplx.Sqrt),
+	"sin":   unary(math.Sin, cmplx.Sin),
+	"cos":   unary(math.Cos, cmplx.Cos),
+	"tan":   unary(math.Tan, cmplx.Tan),
+	"asin":  unary(math.Asin, cmplx.Asin),
+	"acos":  unary(math.Acos, cmplx.Acos),
+	"atan":  unary(math.Atan, cmplx.Atan),
+	"exp":   unary(math.Exp, cmplx.Exp),
+	"ln":    unary(math.Log, cmplx.Log),
+	"abs":   unary(math.Abs, cabs),
+	"floor": unary(math.Floor, nil),
+	"ceil":  unary(math.Ceil, nil),
+	"log": {
+		Arity: 2,
+		Fn: func(args ...float64) float64 {
+			return math.Log(args[0]) / math.Log(args[1])
+		},
+		Complex: func(args ...complex128) complex128 {
+			return cmplx.Log(args[0]) / cmplx.Log(args[1])
+		},
+	},
+	"min": {Variadic, func(args ...float64) float64 {
+		out := args[0]
+		for _, a := range args[1:] {
+			out = math.Min(out, a)
+		}
+		return out
+	}, nil},
+	"max": {Variadic, func(args ...float64) float64 {
+		out := args[0]
+		for _, a := range args[1:] {
+			out = math.Max(out, a)
+		}
+		return out
+	}, nil},
+}
+
+/*Consts are read only, assigning to one of them is an error
+ */
+var Consts = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+/*Register adds a function to the table used by every Env,
+replacing any previous function with the same name
+*/
+func Register(name string, arity int, fn func(args ...float64) float64) {
+	Funcs[name] = &Func{
+		Arity: arity,
+		Fn:    fn,
+	}
+}
+
+func unary(fn func(float64) float64, cfn func(complex128) complex128) *Func {
+	f := &Func{
+		Arity: 1,
+		Fn: func(args ...float64) float64 {
+			return fn(args[0])
+		},
+	}
+	if cfn != nil {
+		f.Complex = func(args ...complex128) complex128 {
+			return cfn(args[0])
+		}
+	}
+	return f
+}
+
+func cabs(z complex128) complex128 {
+	return complex(cmplx.Abs(z), 0)
+}
+
+/*CheckArity returns false if the function can't be called with n arguments
+ */
+func (f *Func) CheckArity(n int) bool {
+	if f.Arity == Variadic {
+		return n > 0
+	}
+	return n == f.Arity
+}
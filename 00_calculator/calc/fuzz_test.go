@@ -0,0 +1,72 @@
+package calc
+
+import (
+	"errors"
+	"testing"
+)
+
+var seeds = []string{
+	"1 + 2 * 3",
+	"-(x - 3) ^ 2 ^ -1 / 4!",
+	"x = sqrt(2) * max(1, 2, 3)",
+	"60 mph in km/h",
+	"3 m^2 * 2 s",
+	"0xff & 0b1010 | 0o7 xor ~1 << 2",
+	"x!=1 && !(y < 2) || 3! == 6",
+	"x > 0 ? x : -x",
+	"f(x, y) = x ^ 2 + y",
+	"(1 + 2i) * 3i",
+	"sqrt(1, )",
+	"1 <",
+	"\xff",
+	"(0A)^(0)",
+	"(3 m)^2 * x",
+	"2 * 9.8 m^2/s^(1 + 1) / s",
+}
+
+func FuzzLex(f *testing.F) {
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		tks, err := Lex(s)
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("%q: error of type %T", s, err)
+			}
+			return
+		}
+		if len(tks) == 0 || tks[len(tks)-1].tp != Teof {
+			t.Fatalf("%q: tokens don't end with EOF: %v", s, tks)
+		}
+	})
+}
+
+/*FuzzParse also checks that Format prints something that
+parses into a tree that's printed in the same way
+*/
+func FuzzParse(f *testing.F) {
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		root, err := ParseStr(s)
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("%q: error of type %T", s, err)
+			}
+			return
+		}
+		out := Format(root)
+		again, err := ParseStr(out)
+		if err != nil {
+			t.Fatalf("%q: formatted as %q, which doesn't parse: %v", s, out, err)
+		}
+		if Format(again) != out {
+			t.Fatalf("%q: formatted as %q, then as %q", s, out, Format(again))
+		}
+		Eval(root, NewEnv())
+	})
+}
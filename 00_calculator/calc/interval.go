@@ -0,0 +1,485 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*Interval is a closed range of float64 that is guaranteed to contain
+the exact result. Go can't change the rounding mode of the FPU, so the
+arithmetic rounds to nearest, then finds the sign of the rounding error,
+and moves the bound one float outwards when it was rounded inwards
+*/
+type Interval struct {
+	Lo, Hi float64
+}
+
+func (i Interval) String() string {
+	return "[" + strconv.FormatFloat(i.Lo, 'g', -1, 64) + ", " + strconv.FormatFloat(i.Hi, 'g', -1, 64) + "]"
+}
+
+func (i Interval) isPoint() bool {
+	return i.Lo == i.Hi
+}
+
+func (i Interval) hasZero() bool {
+	return i.Lo <= 0 && 0 <= i.Hi
+}
+
+var entire = Interval{math.Inf(-1), math.Inf(1)}
+
+/*outward moves the bounds away from each other by one float,
+it's applied to every result that was rounded
+*/
+func outward(lo, hi float64) Interval {
+	return Interval{math.Nextafter(lo, math.Inf(-1)), math.Nextafter(hi, math.Inf(1))}
+}
+
+/*widen moves the bounds by n floats, for functions
+with an error bigger than the last bit, like math.Pow
+*/
+func widen(i Interval, n int) Interval {
+	for ; n > 0; n-- {
+		i = outward(i.Lo, i.Hi)
+	}
+	return i
+}
+
+/*ratInterval is the smallest interval around r, numbers like 0.1
+are not exact in float64, so they become two consecutive floats
+*/
+func ratInterval(r *big.Rat) Interval {
+	f, exact := r.Float64()
+	switch {
+	case exact:
+		return Interval{f, f}
+	case math.IsInf(f, 1):
+		return Interval{math.MaxFloat64, f}
+	case math.IsInf(f, -1):
+		return Interval{f, -math.MaxFloat64}
+	case r.Cmp(new(big.Rat).SetFloat64(f)) < 0:
+		return Interval{math.Nextafter(f, math.Inf(-1)), f}
+	}
+	return Interval{f, math.Nextafter(f, math.Inf(1))}
+}
+
+func StrToInterval(s string) (Value, error) {
+	r, err := StrToRat(s)
+	if err != nil {
+		return nil, err
+	}
+	return ratInterval(r.(Rat).Rat), nil
+}
+
+func toInterval(v Value) Interval {
+	switch v := v.(type) {
+	case Interval:
+		return v
+	case Rat:
+		return ratInterval(v.Rat)
+	case BigFloat:
+		r, _ := v.Rat(nil)
+		if r == nil { // infinite
+			f, _ := v.Float64()
+			return Interval{f, f}
+		}
+		return ratInterval(r)
+	}
+	f := toFloat(v)
+	return Interval{f, f}
+}
+
+/*intervalOf is used for results of float64 code that is only
+correct to the last bit, like constants and functions
+*/
+func intervalOf(f float64) Interval {
+	return outward(f, f)
+}
+
+/*makeInterval evaluates "[a, b]" and "a ± b", the result contains both a and b
+in the first case, and every number at most |b| away from a in the second
+*/
+func makeInterval(op string, a, b Value) (Value, error) {
+	x, y := toInterval(a), toInterval(b)
+	if math.IsNaN(x.Lo) || math.IsNaN(y.Lo) {
+		return nil, errors.New("Intervals can only have real numbers")
+	}
+	if op == "[" {
+		if x.Lo > y.Hi {
+			return nil, errors.New("Empty interval, the lower bound is greater than the upper bound")
+		}
+		return Interval{x.Lo, y.Hi}, nil
+	}
+	r := math.Max(math.Abs(y.Lo), math.Abs(y.Hi))
+	return Interval{add(x.Lo, -r, down), add(x.Hi, r, up)}, nil
+}
+
+func intervalOp(op string, a, b Interval) (Value, error) {
+	switch op {
+	case "+":
+		return Interval{add(a.Lo, b.Lo, down), add(a.Hi, b.Hi, up)}, nil
+	case "-":
+		return Interval{add(a.Lo, -b.Hi, down), add(a.Hi, -b.Lo, up)}, nil
+	case "*":
+		lo, _ := bounds(mul(a.Lo, b.Lo, down), mul(a.Lo, b.Hi, down), mul(a.Hi, b.Lo, down), mul(a.Hi, b.Hi, down))
+		_, hi := bounds(mul(a.Lo, b.Lo, up), mul(a.Lo, b.Hi, up), mul(a.Hi, b.Lo, up), mul(a.Hi, b.Hi, up))
+		return Interval{lo, hi}, nil
+	case "/":
+		return intervalDiv(a, b)
+	case "^":
+		return intervalPow(a, b)
+	case "==", "!=", "<", "<=", ">", ">=":
+		return intervalCompare(op, a, b)
+	}
+	if a.isPoint() && b.isPoint() { // integer operations on exact numbers
+		out, err := floatOp(op, a.Lo, b.Lo)
+		if err != nil {
+			return nil, err
+		}
+		return toInterval(out), nil
+	}
+	return nil, errors.New(op + " is only defined for intervals with a single number")
+}
+
+func intervalUnary(op string, a Interval) (Value, error) {
+	if op == "-" {
+		return Interval{-a.Hi, -a.Lo}, nil
+	}
+	if a.isPoint() && op == "!" {
+		return intervalFactorial(a.Lo), nil
+	}
+	if a.isPoint() {
+		out, err := floatUnary(op, a.Lo)
+		if err != nil {
+			return nil, err
+		}
+		return toInterval(out), nil
+	}
+	return nil, errors.New(op + " is only defined for intervals with a single number")
+}
+
+/*intervalFactorial computes the factorials that fit in a float64 exactly,
+factorial rounds once per multiplication, so its error can be many floats
+*/
+func intervalFactorial(a float64) Interval {
+	if f := factorial(int(a)); math.IsInf(f, 1) {
+		return Interval{math.MaxFloat64, f}
+	}
+	out, _ := intFactorial(big.NewInt(int64(a))) // at most 170!
+	return ratInterval(new(big.Rat).SetInt(out))
+}
+
+var (
+	down = math.Inf(-1)
+	up   = math.Inf(1)
+)
+
+/*directed rounds r, the rounded result of an operation, towards dir.
+err is the sign of the rounding error, the exact result minus r, and finite
+tells if the operands were finite, in which case an infinite r is an overflow.
+Errors of results near zero can't be trusted, so they are always moved
+*/
+func directed(r, err float64, finite bool, dir float64) float64 {
+	switch {
+	case math.IsInf(r, 0):
+		if finite && r*dir < 0 {
+			return math.Copysign(math.MaxFloat64, r)
+		}
+		return r
+	case math.Abs(r) < 0x1p-1022:
+		return math.Nextafter(r, dir)
+	case err*dir > 0:
+		return math.Nextafter(r, dir)
+	}
+	return r
+}
+
+func isFinite(xs ...float64) bool {
+	for _, x := range xs {
+		if math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+/*add uses the TwoSum algorithm, which gives the exact rounding error of a sum,
+sums that round to tiny numbers are always exact
+*/
+func add(a, b, dir float64) float64 {
+	s := a + b
+	bb := s - a
+	err := (a - (s - bb)) + (b - bb)
+	if err == 0 && !math.IsInf(s, 0) {
+		return s
+	}
+	return directed(s, err, isFinite(a, b), dir)
+}
+
+/*mul treats 0 * Inf as 0, the infinite bound is never reached,
+the error of the product is exact with a fused multiply add
+*/
+func mul(a, b, dir float64) float64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	p := a * b
+	return directed(p, math.FMA(a, b, -p), isFinite(a, b), dir)
+}
+
+/*div finds the sign of the error with the remainder a - q*b,
+which is exact with a fused multiply add
+*/
+func div(a, b, dir float64) float64 {
+	q := a / b
+	if !isFinite(a, b) || a == 0 {
+		return q
+	}
+	return directed(q, math.FMA(-q, b, a)*b, true, dir)
+}
+
+/*bounds skips NaN, which comes from Inf/Inf, the other
+corners are enough to bound the result
+*/
+func bounds(xs ...float64) (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, x := range xs {
+		if !math.IsNaN(x) {
+			lo, hi = math.Min(lo, x), math.Max(hi, x)
+		}
+	}
+	if lo > hi {
+		return math.Inf(-1), math.Inf(1)
+	}
+	return lo, hi
+}
+
+/*intervalDiv handles divisors that contain zero. When zero is a bound of
+the divisor the result is a half line, when it's inside the divisor the
+result is the union of two half lines, and the enclosing interval is the
+whole line, the same happens when both intervals contain zero
+*/
+func intervalDiv(a, b Interval) (Value, error) {
+	if b.Lo == 0 && b.Hi == 0 {
+		return nil, errors.New("Division by zero")
+	}
+	if !b.hasZero() {
+		lo, _ := bounds(div(a.Lo, b.Lo, down), div(a.Lo, b.Hi, down), div(a.Hi, b.Lo, down), div(a.Hi, b.Hi, down))
+		_, hi := bounds(div(a.Lo, b.Lo, up), div(a.Lo, b.Hi, up), div(a.Hi, b.Lo, up), div(a.Hi, b.Hi, up))
+		return Interval{lo, hi}, nil
+	}
+	switch {
+	case a.hasZero() || b.Lo < 0 && b.Hi > 0:
+		return entire, nil
+	case b.Lo == 0 && a.Hi < 0:
+		return Interval{down, div(a.Hi, b.Hi, up)}, nil
+	case b.Lo == 0: // a.Lo > 0
+		return Interval{div(a.Lo, b.Hi, down), up}, nil
+	case a.Hi < 0: // b.Hi == 0
+		return Interval{div(a.Hi, b.Lo, down), up}, nil
+	}
+	return Interval{down, div(a.Lo, b.Lo, up)}, nil
+}
+
+/*intervalPow uses the exact rules for integer exponents, so [-2, 3]^2 is
+[0, 9] instead of [-6, 9]. Other exponents need a base that isn't negative,
+and the result is in one of the corners, since x^y is monotonic in x and in y
+*/
+func intervalPow(a, b Interval) (Value, error) {
+	if b.isPoint() && math.Trunc(b.Lo) == b.Lo && math.Abs(b.Lo) < 1<<62 {
+		n := int64(b.Lo)
+		switch {
+		case n == 0:
+			return Interval{1, 1}, nil
+		case n < 0:
+			p, err := intervalPow(a, Interval{float64(-n), float64(-n)})
+			if err != nil {
+				return nil, err
+			}
+			return intervalDiv(Interval{1, 1}, p.(Interval))
+		case n%2 == 0: // even powers only depend on the absolute value
+			lo, hi := bounds(math.Abs(a.Lo), math.Abs(a.Hi))
+			if a.hasZero() {
+				lo = 0
+			}
+			return Interval{powDown(lo, n), powUp(hi, n)}, nil
+		}
+		return Interval{oddPow(a.Lo, n, powDown, powUp), oddPow(a.Hi, n, powUp, powDown)}, nil
+	}
+	if a.Lo < 0 {
+		return nil, errors.New("Negative base with a fractional exponent: " + a.String())
+	}
+	lo, hi := bounds(math.Pow(a.Lo, b.Lo), math.Pow(a.Lo, b.Hi), math.Pow(a.Hi, b.Lo), math.Pow(a.Hi, b.Hi))
+	return widen(Interval{lo, hi}, 4), nil
+}
+
+/*powDown and powUp compute x^n for x >= 0 by squaring,
+rounding every product down or up
+*/
+func powDown(x float64, n int64) float64 {
+	return powRounded(x, n, down)
+}
+
+func powUp(x float64, n int64) float64 {
+	return powRounded(x, n, up)
+}
+
+func powRounded(x float64, n int64, dir float64) float64 {
+	out := 1.0
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			out = mul(out, x, dir)
+		}
+		if n > 1 {
+			x = mul(x, x, dir)
+		}
+	}
+	return out
+}
+
+/*oddPow keeps the sign of x, for negative numbers the
+rounding of the absolute value is the opposite one
+*/
+func oddPow(x float64, n int64, pos, neg func(float64, int64) float64) float64 {
+	if x < 0 {
+		return -neg(-x, n)
+	}
+	return pos(x, n)
+}
+
+/*intervalCompare only answers when the answer is the same for every pair
+of numbers in the intervals, overlapping intervals are an error
+*/
+func intervalCompare(op string, a, b Interval) (Value, error) {
+	less := a.Lo < b.Hi // what can happen
+	greater := a.Hi > b.Lo
+	equal := a.Lo <= b.Hi && b.Lo <= a.Hi
+	var yes, no bool // if op can be true and if it can be false
+	switch op {
+	case "==":
+		yes, no = equal, less || greater
+	case "!=":
+		yes, no = less || greater, equal
+	case "<":
+		yes, no = less, greater || equal
+	case "<=":
+		yes, no = less || equal, greater
+	case ">":
+		yes, no = greater, less || equal
+	case ">=":
+		yes, no = greater || equal, less
+	}
+	if yes && no {
+		return nil, errors.New("Undecided comparison: " + a.String() + " " + op + " " + b.String())
+	}
+	return Bool(yes), nil
+}
+
+/*intervalFuncs are the builtins that work with intervals, they're
+monotonic in pieces, so they only need the bounds of the arguments
+*/
+var intervalFuncs = map[string]func(args ...Interval) (Interval, error){
+	"sqrt": func(args ...Interval) (Interval, error) {
+		a := args[0]
+		if a.Lo < 0 {
+			return Interval{}, errors.New("Square root of negative numbers: " + a.String())
+		}
+		return Interval{sqrt(a.Lo, down), sqrt(a.Hi, up)}, nil
+	},
+	"ln": func(args ...Interval) (Interval, error) {
+		a := args[0]
+		if a.Lo <= 0 {
+			return Interval{}, errors.New("Logarithm of numbers that aren't positive: " + a.String())
+		}
+		return outward(math.Log(a.Lo), math.Log(a.Hi)), nil
+	},
+	"exp":   monotonic(math.Exp, 1),
+	"atan":  monotonic(math.Atan, 1),
+	"floor": monotonic(math.Floor, 0),
+	"ceil":  monotonic(math.Ceil, 0),
+	"abs": func(args ...Interval) (Interval, error) {
+		a := args[0]
+		lo, hi := math.Abs(a.Lo), math.Abs(a.Hi)
+		if a.hasZero() {
+			return Interval{0, math.Max(lo, hi)}, nil
+		}
+		lo, hi = bounds(lo, hi)
+		return Interval{lo, hi}, nil
+	},
+	"min": func(args ...Interval) (Interval, error) {
+		out := args[0]
+		for _, a := range args[1:] {
+			out = Interval{math.Min(out.Lo, a.Lo), math.Min(out.Hi, a.Hi)}
+		}
+		return out, nil
+	},
+	"max": func(args ...Interval) (Interval, error) {
+		out := args[0]
+		for _, a := range args[1:] {
+			out = Interval{math.Max(out.Lo, a.Lo), math.Max(out.Hi, a.Hi)}
+		}
+		return out, nil
+	},
+}
+
+/*sqrt finds the sign of the error with the remainder x - s*s
+ */
+func sqrt(x, dir float64) float64 {
+	s := math.Sqrt(x)
+	if math.IsInf(x, 0) || x == 0 {
+		return s
+	}
+	return directed(s, math.FMA(-s, s, x), true, dir)
+}
+
+/*monotonic makes the interval version of an increasing function,
+ulps is how many floats the results of fn can be away from the exact ones
+*/
+func monotonic(fn func(float64) float64, ulps int) func(args ...Interval) (Interval, error) {
+	return func(args ...Interval) (Interval, error) {
+		return widen(Interval{fn(args[0].Lo), fn(args[0].Hi)}, ulps), nil
+	}
+}
+
+func solveInterval(n *Node, env *Env) (Value, error) {
+	if !env.Interval {
+		return nil, evalError(n, "Intervals are only supported in interval mode")
+	}
+	a, err := solve(n.kids[0], env)
+	if err != nil {
+		return nil, err
+	}
+	if err := notReal(n.kids[0], a); err != nil {
+		return nil, err
+	}
+	b, err := solve(n.kids[1], env)
+	if err != nil {
+		return nil, err
+	}
+	if err := notReal(n.kids[1], b); err != nil {
+		return nil, err
+	}
+	out, err := makeInterval(n.val, a, b)
+	if err != nil {
+		return nil, evalError(n, "%v", err)
+	}
+	return out, nil
+}
+
+func callInterval(n *Node, args []Value) (Value, error) {
+	fn, ok := intervalFuncs[n.val]
+	if !ok {
+		return nil, evalError(n, "%v doesn't support intervals", n.val)
+	}
+	xs := make([]Interval, len(args))
+	for i, a := range args {
+		xs[i] = toInterval(a)
+	}
+	out, err := fn(xs...)
+	if err != nil {
+		return nil, evalError(n, "%v", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package calc
+
+import (
+	"math/big"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"[1, 2] + [3, 4]", "[4, 6]"},
+		{"2 ± 0.5", "[1.5, 2.5]"},
+		{"[-2, 3] ^ 2", "[0, 9]"},
+		{"[-2, 3] ^ 3", "[-8, 27]"},
+		{"[1, 2] / [-1, 2]", "[-Inf, +Inf]"},
+		{"1 / [0, 2]", "[0.5, +Inf]"},
+		{"-1 / [0, 2]", "[-Inf, -0.5]"},
+		{"sqrt([4, 9])", "[2, 3]"},
+		{"[1, 2] < [3, 4]", "true"},
+		{"0.5 * 4", "[2, 2]"},
+		{"[3, 3]!", "[6, 6]"},
+		{"[1, 2] != [3, 4]", "true"},
+	}
+	env := NewEnv()
+	env.Interval = true
+	for _, test := range tests {
+		out, err := Run(test.src, env)
+		if err != nil {
+			t.Errorf("%v: %v", test.src, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("%v: got %v, wanted %v", test.src, out, test.want)
+		}
+	}
+	for _, src := range []string{"[2, 1]", "[1, 2] < [1.5, 3]", "1 / [0, 0]", "[-1, 2] ^ 0.5", "1 m"} {
+		if _, err := Run(src, env); err == nil {
+			t.Errorf("%v: expected an error", src)
+		}
+	}
+}
+
+/*TestIntervalContains evaluates random sums, products and quotients
+of decimals in exact mode and checks that the interval contains the result
+*/
+func TestIntervalContains(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ops := []string{"+", "-", "*", "/"}
+	exact, interval := NewEnv(), NewEnv()
+	exact.Exact = true
+	interval.Interval = true
+	for i := 0; i < 2000; i++ {
+		src := strconv.Itoa(r.Intn(1000)) + "." + strconv.Itoa(r.Intn(1000))
+		for j := r.Intn(6); j >= 0; j-- {
+			src = "(" + src + ") " + ops[r.Intn(len(ops))] + " 0." + strconv.Itoa(1+r.Intn(999))
+		}
+		want, err := Run(src, exact)
+		if err != nil {
+			t.Fatalf("%v: %v", src, err)
+		}
+		got, err := Run(src, interval)
+		if err != nil {
+			t.Fatalf("%v: %v", src, err)
+		}
+		x, w := got.(Interval), want.(Rat).Rat
+		lo, hi := new(big.Rat).SetFloat64(x.Lo), new(big.Rat).SetFloat64(x.Hi)
+		if lo.Cmp(w) > 0 || hi.Cmp(w) < 0 {
+			t.Fatalf("%v: %v doesn't contain %v", src, got, w.FloatString(20))
+		}
+	}
+}
+
+/*TestIntervalFactorial checks that the factorials that fit in a float64
+contain the exact result, factorial rounds after each multiplication
+*/
+func TestIntervalFactorial(t *testing.T) {
+	exact, interval := NewEnv(), NewEnv()
+	exact.Exact = true
+	interval.Interval = true
+	for n := 20; n <= 170; n++ {
+		src := strconv.Itoa(n) + "!"
+		want, err := Run(src, exact)
+		if err != nil {
+			t.Fatalf("%v: %v", src, err)
+		}
+		got, err := Run(src, interval)
+		if err != nil {
+			t.Fatalf("%v: %v", src, err)
+		}
+		x, w := got.(Interval), want.(Rat).Rat
+		lo, hi := new(big.Rat).SetFloat64(x.Lo), new(big.Rat).SetFloat64(x.Hi)
+		if lo.Cmp(w) > 0 || hi.Cmp(w) < 0 {
+			t.Errorf("%v: %v doesn't contain %v", src, got, w.FloatString(0))
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package calc
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*Lex splits the expression into tokens, the last one is always Teof
+*/
+func Lex(s string) ([]*Token, error) {
+	l := &Lexer{
+		s:        s,
+		tks:      make([]*Token, 0),
+		startPos: Pos{Offset: 0, Line: 1, Col: 1},
+	}
+	l.run()
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.tks, nil
+}
+
+const (
+	Tnum TokenType = iota
+	Tid
+	Tope
+	Teof
+
+	Tunit // an identifier right after a number
+	Tnot  // a "!" that doesn't follow an operand, the prefix logical not
+
+	Tcall // never emitted by the lexer, the parser marks function calls with it
+)
+
+// this represents the eof as a rune. it differs from the TokenType above
+const eof = utf8.RuneError
+
+var printMap = map[TokenType]string{
+	Tnum: "int",
+	Tid:  "id",
+	Tope: "ope",
+	Teof: "EOF",
+
+	Tunit: "unit",
+	Tnot:  "not",
+	Tcall: "call",
+}
+
+/*TokenType tells what kind of token the lexer found, Tnum, Tid, ...
+*/
+type TokenType int
+
+type lexState func(*Lexer) lexState
+
+/*Token is a piece of the expression, Parse keeps it in each Node
+*/
+type Token struct {
+	val  string
+	tp   TokenType
+	span Span
+}
+
+/*Value is the text of the token, numbers keep their sign and prefix
+*/
+func (l *Token) Value() string {
+	return l.val
+}
+
+func (l *Token) Type() TokenType {
+	return l.tp
+}
+
+/*Span is where the token is in the expression
+*/
+func (l *Token) Span() Span {
+	return l.span
+}
+
+func (l *Token) DebugStr() string {
+	return fmt.Sprintf("tk{val: %v, tp: %v}", l.val, printMap[l.tp])
+}
+
+func (l *Token) String() string {
+	if l.tp == Teof {
+		return "EOF"
+	}
+	return l.val
+}
+
+type Lexer struct {
+	s          string
+	start, end int
+	startPos   Pos // position of start
+	tks        []*Token
+	err        *Error
+
+	lastRuneWid int
+}
+
+func (l *Lexer) next() rune {
+	r, w := utf8.DecodeRuneInString(l.s[l.end:])
+	if r == utf8.RuneError && w == 1 { // stops the lexer as if it was the end of input
+		l.ignore()
+		l.end += w
+		l.lastRuneWid = 0 // nothing to unread, the error already stopped the lexer
+		l.errorf("Invalid UTF8 rune in string")
+		return eof
+	}
+	l.end += w
+	l.lastRuneWid = w
+	return r
+}
+
+func (l *Lexer) unread() {
+	l.end -= l.lastRuneWid
+	l.lastRuneWid = 0
+}
+
+func (l *Lexer) ignore() {
+	l.startPos = l.endPos()
+	l.start = l.end
+}
+
+func (l *Lexer) emit(tp TokenType) {
+	end := l.endPos()
+	tk := &Token{
+		val:  l.s[l.start:l.end],
+		tp:   tp,
+		span: Span{Start: l.startPos, End: end},
+	}
+	l.tks = append(l.tks, tk)
+	l.startPos = end
+	l.start = l.end
+}
+
+/*endPos computes the position of end by walking the text since start
+ */
+func (l *Lexer) endPos() Pos {
+	p := l.startPos
+	for _, r := range l.s[l.start:l.end] {
+		if r == '\n' {
+			p.Line++
+			p.Col = 1
+		} else {
+			p.Col++
+		}
+	}
+	p.Offset = l.end
+	return p
+}
+
+func (l *Lexer) accept(s string) bool {
+	if strings.ContainsRune(s, l.next()) {
+		return true
+	}
+	l.unread()
+	return false
+}
+
+func (l *Lexer) acceptRun(s string) {
+	for strings.ContainsRune(s, l.next()) {
+	}
+	l.unread()
+}
+
+/*errorf records the error with the text read since the last emit
+and returns a nil state, which stops the lexer
+*/
+func (l *Lexer) errorf(format string, a ...interface{}) lexState {
+	if l.err == nil {
+		l.err = &Error{
+			Kind:   LexErr,
+			Offset: l.start,
+			Span:   Span{Start: l.startPos, End: l.endPos()},
+			Token:  l.s[l.start:l.end],
+			Msg:    fmt.Sprintf(format, a...),
+		}
+	}
+	return nil
+}
+
+func (l *Lexer) run() {
+	current := any
+	for current != nil && l.err == nil {
+		current = current(l)
+	}
+}
+
+func any(l *Lexer) lexState {
+	r := l.next()
+	switch r {
+	case ' ', '\n', '\t':
+		l.ignore()
+		return any
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		l.unread()
+		return number
+	case '+', '-', '/', '*', '(', ')', '%', '^', ',', '~', '?', ':', '[', ']', '±':
+		l.emit(Tope)
+		return any
+	case '<', '>': // "<<", "<=" and "<"
+		l.accept(string(r) + "=")
+		l.emit(Tope)
+		return any
+	case '&', '|': // "&&" and "&"
+		l.accept(string(r))
+		l.emit(Tope)
+		return any
+	case '=': // "==" and "="
+		l.accept("=")
+		l.emit(Tope)
+		return any
+	case '!':
+		return bang
+	case eof:
+		l.emit(Teof)
+		return nil
+	default:
+		if isLetter(r) {
+			return ident
+		}
+		return l.errorf("Invalid rune: %v", string(r))
+	}
+}
+
+/*bang tells apart the three meanings of "!". The longest match wins,
+so "x!=1" is "x != 1". Otherwise a "!" after an operand is the postfix
+factorial, and anywhere else it's the prefix logical not
+*/
+func bang(l *Lexer) lexState {
+	if l.accept("=") {
+		l.emit(Tope)
+		return any
+	}
+	if l.afterOperand() {
+		l.emit(Tope)
+		return any
+	}
+	l.emit(Tnot)
+	return any
+}
+
+/*afterOperand reports if the last token ends an operand,
+like a number, an identifier, ")", "]" or a factorial
+*/
+func (l *Lexer) afterOperand() bool {
+	if len(l.tks) == 0 {
+		return false
+	}
+	last := l.tks[len(l.tks)-1]
+	switch last.tp {
+	case Tnum, Tid, Tunit:
+		return true
+	case Tope:
+		return last.val == ")" || last.val == "]" || last.val == "!"
+	}
+	return false
+}
+
+/*bases maps the prefix of a number to it's digits,
+the prefixes are the same of Go, "0x", "0b" and "0o"
+*/
+var bases = map[string]string{
+	"x": "0123456789abcdefABCDEF",
+	"b": "01",
+	"o": "01234567",
+}
+
+func number(l *Lexer) lexState {
+	if l.accept("0") && l.accept("xbo") {
+		digits := bases[l.s[l.end-1:l.end]]
+		start := l.end
+		l.acceptRun(digits)
+		if l.end == start {
+			return l.errorf("Number prefix without digits")
+		}
+		l.emit(Tnum)
+		return unit
+	}
+	l.acceptRun("0123456789")
+	if l.accept(".") {
+		l.acceptRun("0123456789")
+	}
+	// an "i" right after the digits makes it imaginary, unless it starts an identifier, like "3in"
+	if rest := l.s[l.end:]; strings.HasPrefix(rest, "i") {
+		r, _ := utf8.DecodeRuneInString(rest[1:])
+		if !isLetter(r) && !unicode.IsDigit(r) {
+			l.end++
+		}
+	}
+	l.emit(Tnum)
+	return unit
+}
+
+/*unit looks past the spaces after a number, if an identifier
+follows it's the unit of the number. Keywords are still keywords
+*/
+func unit(l *Lexer) lexState {
+	l.acceptRun(" \n\t")
+	l.ignore()
+	if !isLetter(l.next()) {
+		l.unread()
+		return any
+	}
+	l.acceptIdent()
+	if tp, ok := keywords[l.s[l.start:l.end]]; ok {
+		l.emit(tp)
+		return any
+	}
+	l.emit(Tunit)
+	return any
+}
+
+/*ident is entered after the first letter was already read,
+digits are allowed anywhere but at the start
+*/
+func ident(l *Lexer) lexState {
+	l.acceptIdent()
+	if tp, ok := keywords[l.s[l.start:l.end]]; ok {
+		l.emit(tp)
+		return any
+	}
+	l.emit(Tid)
+	return any
+}
+
+// keywords are identifiers that are lexed as other types
+var keywords = map[string]TokenType{
+	"in":  Tope,
+	"xor": Tope,
+}
+
+func (l *Lexer) acceptIdent() {
+	for {
+		r := l.next()
+		if !isLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+	}
+	l.unread()
+}
+
+func isLetter(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
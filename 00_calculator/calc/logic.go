@@ -0,0 +1,112 @@
+package calc
+
+import "errors"
+
+/*solveLogic evaluates "!", "&&", "||" and "?", they only take booleans
+and they don't evaluate the operands that can't change the result
+*/
+func solveLogic(n *Node, env *Env) (Value, error) {
+	cond, err := solveBool(n.kids[0], env)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n.tp == Tnot:
+		return Bool(!cond), nil
+	case n.val == "?":
+		if cond {
+			return solve(n.kids[1], env)
+		}
+		return solve(n.kids[2], env)
+	case n.val == "&&" && !cond, n.val == "||" && cond:
+		return Bool(cond), nil
+	}
+	out, err := solveBool(n.kids[1], env)
+	if err != nil {
+		return nil, err
+	}
+	return Bool(out), nil
+}
+
+func isLogic(n *Node) bool {
+	return n.tp == Tnot || n.tp == Tope && (n.val == "&&" || n.val == "||" || n.val == "?")
+}
+
+func solveBool(n *Node, env *Env) (bool, error) {
+	v, err := solve(n, env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(Bool)
+	if !ok {
+		return false, evalError(n, "Expected a boolean, got %v", v)
+	}
+	return bool(b), nil
+}
+
+/*notBool is used where a boolean would silently become NaN
+ */
+func notBool(n *Node, v Value) error {
+	if _, ok := v.(Bool); ok {
+		return evalError(n, "Expected a number, got %v", v)
+	}
+	return nil
+}
+
+/*boolOp is called by DoOp when any of the operands is a Bool,
+booleans can only be compared for equality with other booleans
+*/
+func boolOp(op string, a, b Value) (Value, error) {
+	x, okA := a.(Bool)
+	y, okB := b.(Bool)
+	if !okA || !okB {
+		return nil, errors.New("Can't mix booleans and numbers in " + op)
+	}
+	switch op {
+	case "==":
+		return Bool(x == y), nil
+	case "!=":
+		return Bool(x != y), nil
+	}
+	return nil, errors.New("Invalid operation for booleans: " + op)
+}
+
+/*compare turns the result of a Cmp method into the result of op
+ */
+func compare(op string, c int) (Value, error) {
+	switch op {
+	case "==":
+		return Bool(c == 0), nil
+	case "!=":
+		return Bool(c != 0), nil
+	case "<":
+		return Bool(c < 0), nil
+	case "<=":
+		return Bool(c <= 0), nil
+	case ">":
+		return Bool(c > 0), nil
+	case ">=":
+		return Bool(c >= 0), nil
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+/*floatCompare doesn't use compare, every comparison with NaN is false but "!="
+ */
+func floatCompare(op string, a, b float64) (Value, error) {
+	switch op {
+	case "==":
+		return Bool(a == b), nil
+	case "!=":
+		return Bool(a != b), nil
+	case "<":
+		return Bool(a < b), nil
+	case "<=":
+		return Bool(a <= b), nil
+	case ">":
+		return Bool(a > b), nil
+	case ">=":
+		return Bool(a >= b), nil
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
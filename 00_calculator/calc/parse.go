@@ -0,0 +1,601 @@
+package calc
+
+/*Node is a node of the AST returned by Parse, the Token is the
+operator, function, number or identifier and the Kids are its operands.
+Node.Span covers the node and all of it's kids, while Node.Token.Span
+only covers the token
+*/
+type Node struct {
+	*Token
+	kids []*Node
+	span Span
+}
+
+func newNode(l *Token) *Node {
+	return &Node{
+		Token: l,
+		kids:   []*Node{},
+		span:   l.span,
+	}
+}
+
+func (n *Node) Kids() []*Node {
+	return n.kids
+}
+
+func (n *Node) Span() Span {
+	return n.span
+}
+
+func (n *Node) newLeaf(kid *Node) *Node {
+	n.kids = append(n.kids, kid)
+	n.span = n.span.join(kid.span)
+	return kid
+}
+
+func (n *Node) String() string {
+	return n.ast(0)
+}
+
+func (n *Node) ast(i int) string {
+	output := n.Token.String() + "\n"
+	for _, kid := range n.kids {
+		output += indent(i) + kid.ast(i+1)
+	}
+	return output
+}
+
+func indent(n int) string {
+	output := ""
+	for i := -1; i < n-1; i++ {
+		output += "   "
+	}
+	output += "└─>"
+	return output
+}
+
+/*Parse builds the AST of a single statement. Syntax errors
+unwind the recursive descent with a panic that is recovered here
+*/
+func Parse(tks []*Token) (root *Node, err error) {
+	if len(tks) == 0 || tks[len(tks)-1].tp != Teof {
+		return nil, &Error{Kind: SyntaxErr, Token: "EOF", Msg: "Token stream must end with EOF"}
+	}
+	p := &Parser{
+		tks:  tks,
+		word: tks[0],
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			root, err = nil, e
+		}
+	}()
+	root = p.Stmt()
+	if p.word.tp != Teof {
+		p.Fail(followFactor...)
+	}
+	return root, nil
+}
+
+/*ParseStr lexes and parses the expression
+*/
+func ParseStr(s string) (*Node, error) {
+	tks, err := Lex(s)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(tks)
+}
+
+type Parser struct {
+	i    int
+	tks  []*Token
+	word *Token
+}
+
+func (p *Parser) next() {
+	if p.i < len(p.tks)-1 {
+		p.i++
+		p.word = p.tks[p.i]
+	}
+}
+
+func (p *Parser) previous() {
+	if p.i > 0 {
+		p.i--
+		p.word = p.tks[p.i]
+	}
+}
+
+/*Terminals that can start or follow a Factor, they're listed
+in syntax errors as what the parser expected to find
+*/
+var (
+	firstFactor  = []string{`"("`, `"["`, `"+"`, `"-"`, `"~"`, "number", "identifier"}
+	followFactor = []string{`"+"`, `"-"`, `"*"`, `"/"`, `"%"`, `"^"`, `"!"`, `"±"`, `"<<"`, `">>"`, `"&"`, `"xor"`, `"|"`,
+		"comparison", `"&&"`, `"||"`, `"?"`, `"in"`, "EOF"}
+)
+
+/*Fail aborts the parsing, expected are the terminals
+the current grammar rule would accept instead of p.word
+*/
+func (p *Parser) Fail(expected ...string) *Node {
+	panic(syntaxError(p.word, expected))
+}
+
+func (p *Parser) expect(val string) *Token {
+	if p.word.val != val || p.word.tp != Tope {
+		p.Fail(`"` + val + `"`)
+	}
+	l := p.word
+	p.next()
+	return l
+}
+
+/*Stmt needs two tokens of lookahead to tell an assignment from an
+expression that starts with a variable, so it backtracks with p.previous.
+A definition is only known at the "=" after the parameters, so the
+tokens are scanned before parsing, see isDef
+*/
+func (p *Parser) Stmt() *Node {
+	if p.isDef() {
+		return p.Def()
+	}
+	if p.word.tp == Tid {
+		id := newNode(p.word)
+		p.next()
+		if p.word.val == "=" {
+			parent := newNode(p.word) // "=" node
+			parent.newLeaf(id)
+			p.next()
+			parent.newLeaf(p.Conv())
+			return parent
+		}
+		p.previous()
+	}
+	return p.Conv()
+}
+
+/*isDef looks for the "=" after the parenthesis that
+follow an identifier, without moving the parser
+*/
+func (p *Parser) isDef() bool {
+	tks := p.tks[p.i:]
+	if len(tks) < 2 || tks[0].tp != Tid || tks[1].val != "(" || tks[1].tp != Tope {
+		return false
+	}
+	depth := 0
+	for i, tk := range tks[1:] {
+		if tk.tp != Tope {
+			continue
+		}
+		switch tk.val {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 {
+			next := tks[i+2]
+			return next.val == "=" && next.tp == Tope
+		}
+	}
+	return false
+}
+
+/*Def parses the definition of a function, the first kid of the "=" node
+is the call node, with the parameters as kids, and the second is the body
+*/
+func (p *Parser) Def() *Node {
+	call := newNode(p.word)
+	call.tp = Tcall
+	p.next()
+	p.expect("(")
+	if p.word.val != ")" || p.word.tp != Tope {
+		call.newLeaf(p.Param())
+		for p.word.val == "," && p.word.tp == Tope {
+			p.next()
+			call.newLeaf(p.Param())
+		}
+	}
+	if p.word.val != ")" || p.word.tp != Tope {
+		p.Fail(`","`, `")"`)
+	}
+	call.span = call.span.join(p.word.span)
+	p.next()
+	parent := newNode(p.expect("="))
+	parent.newLeaf(call)
+	parent.newLeaf(p.Conv())
+	return parent
+}
+
+func (p *Parser) Param() *Node {
+	if p.word.tp != Tid {
+		return p.Fail("identifier")
+	}
+	n := newNode(p.word)
+	p.next()
+	return n
+}
+
+/*Conv converts the value of the expression to the given units,
+the identifiers on the right side are always units, never variables
+*/
+func (p *Parser) Conv() *Node {
+	last := p.Expr()
+	if p.word.val == "in" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.UnitExpr())
+		return parent
+	}
+	return last
+}
+
+func (p *Parser) UnitExpr() *Node {
+	last := p.UnitPow()
+	for p.word.val == "*" || p.word.val == "/" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.UnitPow())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) UnitPow() *Node {
+	if p.word.tp != Tid && p.word.tp != Tunit {
+		return p.Fail("unit")
+	}
+	p.word.tp = Tunit
+	n := newNode(p.word)
+	p.next()
+	if p.word.val == "^" {
+		parent := newNode(p.word)
+		parent.newLeaf(n)
+		p.next()
+		parent.newLeaf(p.Factor())
+		return parent
+	}
+	return n
+}
+
+/*Expr is the top of the expression grammar, so parenthesis and arguments
+don't need to change when a new lowest precedence level is added
+*/
+func (p *Parser) Expr() *Node {
+	return p.Cond()
+}
+
+/*Cond is right recursive, so "a ? b : c ? d : e" is "a ? b : (c ? d : e)",
+the three kids of the "?" node are the condition and both branches
+*/
+func (p *Parser) Cond() *Node {
+	cond := p.Or()
+	if p.word.val == "?" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(cond)
+		p.next()
+		parent.newLeaf(p.Expr())
+		p.expect(":")
+		parent.newLeaf(p.Expr())
+		return parent
+	}
+	return cond
+}
+
+func (p *Parser) Or() *Node {
+	last := p.And()
+	for p.word.val == "||" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.And())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) And() *Node {
+	last := p.Not()
+	for p.word.val == "&&" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Not())
+		last = parent
+	}
+	return last
+}
+
+/*Not binds looser than the comparisons, so "!x < 3" is "!(x < 3)"
+and "!x!" is "!(x!)", the other way around would always be an error
+*/
+func (p *Parser) Not() *Node {
+	if p.word.tp == Tnot {
+		parent := newNode(p.word)
+		p.next()
+		parent.newLeaf(p.Not())
+		return parent
+	}
+	return p.Cmp()
+}
+
+var cmpOps = map[string]bool{
+	"==": true,
+	"!=": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
+/*Cmp doesn't repeat, "1 < x < 3" is a syntax error
+instead of comparing a boolean with 3
+*/
+func (p *Parser) Cmp() *Node {
+	last := p.BitOr()
+	if cmpOps[p.word.val] && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.BitOr())
+		return parent
+	}
+	return last
+}
+
+/*The bitwise operators have lower precedence than the arithmetic ones,
+so "1 << 2 + 1" is 8 and "6 & 3 | 8" is 10
+*/
+func (p *Parser) BitOr() *Node {
+	last := p.BitXor()
+	for p.word.val == "|" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.BitXor())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) BitXor() *Node {
+	last := p.BitAnd()
+	for p.word.val == "xor" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.BitAnd())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) BitAnd() *Node {
+	last := p.Shift()
+	for p.word.val == "&" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Shift())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) Shift() *Node {
+	last := p.Sum()
+	for p.word.val == "<<" || p.word.val == ">>" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Sum())
+		last = parent
+	}
+	return last
+}
+
+/*Whenever we sucessfully match a terminal p.Next will be present in the same block
+ */
+func (p *Parser) Sum() *Node {
+	last := p.Tol()
+	for p.word.val == "+" || p.word.val == "-" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Tol())
+		last = parent
+	}
+	return last
+}
+
+/*Tol is a value with a tolerance, "2 ± 0.1" is the interval [1.9, 2.1].
+It binds tighter than "+", so "1 + 2 ± 0.1" is "1 + (2 ± 0.1)"
+*/
+func (p *Parser) Tol() *Node {
+	last := p.Term()
+	if p.word.val == "±" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Term())
+		return parent
+	}
+	return last
+}
+
+func (p *Parser) Term() *Node {
+	last := p.Power()
+	for p.word.val == "*" || p.word.val == "/" || p.word.val == "%" {
+		parent := newNode(p.word)
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Power())
+		last = parent
+	}
+	return last
+}
+
+func (p *Parser) Power() *Node {
+	last := p.Unary()
+	if p.word.val == "^" {
+		parent := newNode(p.word) // "^" node
+		parent.newLeaf(last)
+		p.next()
+		parent.newLeaf(p.Power())
+		return parent
+	}
+	return last
+}
+
+func (p *Parser) Unary() *Node {
+	last := p.Factor()
+	if p.word.val == "!" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		p.next()
+		parent.newLeaf(last)
+		return parent
+	}
+	return last
+}
+
+/*Factor parses both SigNum and SigVar, since they share the optional signal.
+Numbers absorb the signal, anything else becomes the kid of a unary "-".
+The bitwise not is never absorbed, "~" is always a unary node
+*/
+func (p *Parser) Factor() *Node {
+	if p.word.val == "~" && p.word.tp == Tope {
+		parent := newNode(p.word)
+		p.next()
+		parent.newLeaf(p.Factor())
+		return parent
+	}
+	var sig *Token // optional signal
+	if p.word.val == "+" || p.word.val == "-" {
+		sig = p.word
+		p.next()
+	}
+	if p.word.tp == Tnum {
+		if sig != nil {
+			p.word.val = sig.val + p.word.val // push signal to the beginning of the number
+			p.word.span = p.word.span.join(sig.span)
+		}
+		n := newNode(p.word)
+		p.next()
+		if p.word.tp == Tunit {
+			return p.Unit(n)
+		}
+		return n
+	}
+	var n *Node
+	switch {
+	case p.word.val == "(" && p.word.tp == Tope:
+		n = p.Paren()
+	case p.word.val == "[" && p.word.tp == Tope:
+		n = p.Interval()
+	case p.word.tp == Tid:
+		n = p.Var()
+	case sig != nil:
+		return p.Fail(`"("`, `"["`, "number", "identifier")
+	default:
+		return p.Fail(firstFactor...)
+	}
+	if sig != nil && sig.val == "-" {
+		parent := newNode(sig)
+		parent.newLeaf(n)
+		return parent
+	}
+	return n
+}
+
+/*Unit makes the number the first kid of it's unit, followed
+by the optional exponent of the unit, so "3 m^2" is 3 square meters.
+The units that follow it without spaces are multiplied or divided
+*/
+func (p *Parser) Unit(num *Node) *Node {
+	parent := newNode(p.word)
+	parent.newLeaf(num)
+	p.next()
+	if p.word.val == "^" {
+		p.next()
+		parent.newLeaf(p.Factor())
+	}
+	last := parent
+	for p.compound() {
+		op := newNode(p.word)
+		op.newLeaf(last)
+		p.next()
+		op.newLeaf(p.UnitPow())
+		last = op
+	}
+	return last
+}
+
+/*compound tells if the unit goes on with "*" or "/" and an identifier,
+written without spaces, like "9.8 m/s^2", otherwise they're operators
+and the identifier is a variable
+*/
+func (p *Parser) compound() bool {
+	if p.word.tp != Tope || p.word.val != "*" && p.word.val != "/" || p.i+1 >= len(p.tks) {
+		return false
+	}
+	prev, next := p.tks[p.i-1], p.tks[p.i+1]
+	return next.tp == Tid &&
+		prev.span.End.Offset == p.word.span.Start.Offset &&
+		p.word.span.End.Offset == next.span.Start.Offset
+}
+
+/*Interval is a "[" node with the two bounds as kids
+ */
+func (p *Parser) Interval() *Node {
+	n := newNode(p.expect("["))
+	n.newLeaf(p.Expr())
+	p.expect(",")
+	n.newLeaf(p.Expr())
+	n.span = n.span.join(p.expect("]").span)
+	return n
+}
+
+func (p *Parser) Paren() *Node {
+	open := p.expect("(")
+	n := p.Expr()
+	close := p.expect(")")
+	n.span = n.span.join(open.span).join(close.span)
+	return n
+}
+
+/*Var parses a variable or a Call, an identifier followed by "(" is a Call,
+it's token is marked as such so the evaluator doesn't mistake it for a variable
+*/
+func (p *Parser) Var() *Node {
+	n := newNode(p.word)
+	p.next()
+	if p.word.val == "(" && p.word.tp == Tope {
+		n.tp = Tcall
+		p.Args(n)
+	}
+	return n
+}
+
+func (p *Parser) Args(call *Node) {
+	p.expect("(")
+	if p.word.val != ")" {
+		call.newLeaf(p.Expr())
+		for p.word.val == "," {
+			p.next()
+			call.newLeaf(p.Expr())
+		}
+	}
+	if p.word.val != ")" {
+		p.Fail(`","`, `")"`)
+	}
+	call.span = call.span.join(p.word.span)
+	p.next()
+}
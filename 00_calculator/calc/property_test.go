@@ -0,0 +1,104 @@
+package calc
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+var (
+	randArith = []string{"+", "-", "*", "/", "%", "^", "^", "&", "|", "xor", "<<", ">>"}
+	randCmp   = []string{"==", "!=", "<", "<=", ">", ">="}
+	randCalls = map[string]int{"sqrt": 1, "ln": 1, "log": 2, "min": 3, "max": 2}
+	randNames = []string{"sqrt", "ln", "log", "min", "max"}
+)
+
+/*randNum builds a random numeric expression with at most depth levels,
+conditions are built by randBool, so most trees evaluate without errors
+*/
+func randNum(r *rand.Rand, depth int) *Node {
+	if depth == 0 || r.Intn(5) == 0 {
+		return randLeaf(r)
+	}
+	switch r.Intn(12) {
+	case 0:
+		return opNode("-", randNum(r, depth-1))
+	case 1:
+		return opNode("~", randNum(r, depth-1))
+	case 2:
+		return opNode("!", randNum(r, depth-1))
+	case 3:
+		return opNode("?", randBool(r, depth-1), randNum(r, depth-1), randNum(r, depth-1))
+	case 4:
+		name := randNames[r.Intn(len(randNames))]
+		args := make([]*Node, randCalls[name])
+		for i := range args {
+			args[i] = randNum(r, depth-1)
+		}
+		return callNode(name, args...)
+	}
+	return opNode(randArith[r.Intn(len(randArith))], randNum(r, depth-1), randNum(r, depth-1))
+}
+
+func randBool(r *rand.Rand, depth int) *Node {
+	if depth == 0 {
+		return newNode(&Token{val: "true", tp: Tid})
+	}
+	switch r.Intn(5) {
+	case 0:
+		return newNode(&Token{val: "!", tp: Tnot}).addKids(randBool(r, depth-1))
+	case 1:
+		return opNode("&&", randBool(r, depth-1), randBool(r, depth-1))
+	case 2:
+		return opNode("||", randBool(r, depth-1), randBool(r, depth-1))
+	}
+	return opNode(randCmp[r.Intn(len(randCmp))], randNum(r, depth-1), randNum(r, depth-1))
+}
+
+func randLeaf(r *rand.Rand) *Node {
+	switch r.Intn(6) {
+	case 0:
+		return newNode(&Token{val: "x", tp: Tid})
+	case 1:
+		return newNode(&Token{val: "y", tp: Tid})
+	case 2:
+		return numNode("-" + strconv.Itoa(r.Intn(10)))
+	case 3:
+		return numNode(strconv.Itoa(r.Intn(10)) + ".5")
+	}
+	return numNode(strconv.Itoa(r.Intn(10)))
+}
+
+func (n *Node) addKids(kids ...*Node) *Node {
+	for _, kid := range kids {
+		n.newLeaf(kid)
+	}
+	return n
+}
+
+/*TestFormatRoundTrip prints random trees, parses them again, and checks
+that both evaluate to the same value. A missing or extra parenthesis
+changes the shape of the tree, and almost always the result
+*/
+func TestFormatRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	env := NewEnv()
+	env.Vars["x"] = Float(2.5)
+	env.Vars["y"] = Float(-3)
+	for i := 0; i < 5000; i++ {
+		tree := randNum(r, 5)
+		src := Format(tree)
+		again, err := ParseStr(src)
+		if err != nil {
+			t.Fatalf("%v\ndoesn't parse: %v\ntree:\n%v", src, err, tree)
+		}
+		want, wantErr := solve(tree, env)
+		got, gotErr := solve(again, env)
+		if (wantErr == nil) != (gotErr == nil) {
+			t.Fatalf("%v\nerrors differ: %v, %v\ntree:\n%v\nparsed:\n%v", src, wantErr, gotErr, tree, again)
+		}
+		if wantErr == nil && want.String() != got.String() {
+			t.Fatalf("%v\ngot %v, wanted %v\ntree:\n%v\nparsed:\n%v", src, got, want, tree, again)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package calc
+
+import (
+	"math"
+	"strconv"
+)
+
+/*Simplify returns a new tree where subtrees without identifiers
+are folded into literals and some identities are applied:
+
+	x*1 = 1*x = x+0 = 0+x = x-0 = x/1 = x^1 = x
+	x*0 = 0*x = 0
+	x*-1 = -1*x = -x
+	x^0 = 1^x = 1
+	0-x = -x
+	-(-x) = x
+	true ? a : b = a
+	false ? a : b = b
+
+Constants are evaluated with env, so folding is exact in exact mode.
+Subtrees that fail to evaluate, like 1/0, are kept as they are
+*/
+func Simplify(n *Node, env *Env) *Node {
+	out := &Node{
+		Token: n.Token,
+		kids:   make([]*Node, len(n.kids)),
+		span:   n.span,
+	}
+	for i, kid := range n.kids {
+		out.kids[i] = Simplify(kid, env)
+	}
+	if n.tp == Tnum || n.val == "=" {
+		return out
+	}
+	if isConst(out) {
+		if v, err := solve(out, env); err == nil {
+			if lit := valueNode(v); lit != nil {
+				return lit
+			}
+		}
+	}
+	return identity(out)
+}
+
+func identity(n *Node) *Node {
+	if n.tp != Tope {
+		return n
+	}
+	if len(n.kids) == 1 {
+		kid := n.kids[0]
+		if n.val == "-" && kid.tp == Tope && kid.val == "-" && len(kid.kids) == 1 {
+			return kid.kids[0]
+		}
+		return n
+	}
+	if n.val == "?" {
+		if b, ok := Bools[n.kids[0].val]; ok && n.kids[0].tp == Tid {
+			if b {
+				return n.kids[1]
+			}
+			return n.kids[2]
+		}
+		return n
+	}
+	a, b := n.kids[0], n.kids[1]
+	switch n.val {
+	case "+":
+		if isLit(a, 0) {
+			return b
+		}
+		if isLit(b, 0) {
+			return a
+		}
+	case "-":
+		if isLit(b, 0) {
+			return a
+		}
+		if isLit(a, 0) {
+			return identity(opNode("-", b))
+		}
+	case "*":
+		if isLit(a, 0) || isLit(b, 0) {
+			return numNode("0")
+		}
+		if isLit(a, 1) {
+			return b
+		}
+		if isLit(b, 1) {
+			return a
+		}
+		if isLit(a, -1) {
+			return identity(opNode("-", b))
+		}
+		if isLit(b, -1) {
+			return identity(opNode("-", a))
+		}
+	case "/":
+		if isLit(b, 1) {
+			return a
+		}
+	case "^":
+		if isLit(b, 0) || isLit(a, 1) {
+			return numNode("1")
+		}
+		if isLit(b, 1) {
+			return a
+		}
+	}
+	return n
+}
+
+/*isConst is true for trees made only of literals,
+calls are constant if all their arguments are
+*/
+func isConst(n *Node) bool {
+	if _, ok := Bools[n.val]; ok && n.tp == Tid {
+		return true
+	}
+	if n.tp == Tid || n.val == "=" {
+		return false
+	}
+	for _, kid := range n.kids {
+		if !isConst(kid) {
+			return false
+		}
+	}
+	return true
+}
+
+func isLit(n *Node, v float64) bool {
+	if n.tp != Tnum {
+		return false
+	}
+	f, err := StrToFloat(n.val)
+	return err == nil && f == v
+}
+
+/*valueNode turns a value back into a literal, fractions become
+a division of two literals since Num has no fractions. It returns
+nil for values that have no literal, like NaN and Inf
+*/
+func valueNode(v Value) *Node {
+	switch v := v.(type) {
+	case Float:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		return numNode(strconv.FormatFloat(f, 'f', -1, 64))
+	case Rat:
+		if v.IsInt() {
+			return numNode(v.Num().String())
+		}
+		return opNode("/", numNode(v.Num().String()), numNode(v.Denom().String()))
+	case BigFloat:
+		if v.IsInf() {
+			return nil
+		}
+		return numNode(v.Text('f', -1))
+	case Bool:
+		return newNode(&Token{val: v.String(), tp: Tid})
+	case Interval:
+		lo, hi := valueNode(Float(v.Lo)), valueNode(Float(v.Hi))
+		if lo == nil || hi == nil {
+			return nil
+		}
+		return opNode("[", lo, hi)
+	case Complex:
+		re, im := real(v), imag(v)
+		if math.IsNaN(re) || math.IsInf(re, 0) || math.IsNaN(im) || math.IsInf(im, 0) {
+			return nil
+		}
+		op := "+"
+		if im < 0 {
+			op, im = "-", -im
+		}
+		imNode := numNode(strconv.FormatFloat(im, 'f', -1, 64) + "i")
+		if re == 0 {
+			if op == "-" {
+				imNode.val = "-" + imNode.val
+			}
+			return imNode
+		}
+		return opNode(op, valueNode(Float(re)), imNode)
+	}
+	return nil
+}
+
+/*numNode and opNode create nodes that don't come from the input,
+so their spans are empty
+*/
+func numNode(val string) *Node {
+	return newNode(&Token{val: val, tp: Tnum})
+}
+
+func opNode(op string, kids ...*Node) *Node {
+	n := newNode(&Token{val: op, tp: Tope})
+	for _, kid := range kids {
+		n.newLeaf(kid)
+	}
+	return n
+}
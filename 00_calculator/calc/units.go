@@ -0,0 +1,260 @@
+package calc
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*Dim is the exponent of each SI base unit, in the order of baseUnits
+ */
+type Dim [7]int8
+
+var baseUnits = [7]string{"m", "kg", "s", "A", "K", "mol", "cd"}
+
+func dim(m, kg, s, A, K, mol, cd int8) Dim {
+	return Dim{m, kg, s, A, K, mol, cd}
+}
+
+func (d Dim) IsZero() bool {
+	return d == Dim{}
+}
+
+/*String writes the dimension with base units, the ones with
+positive exponents come before the "/"
+*/
+func (d Dim) String() string {
+	num, den := []string{}, []string{}
+	for i, e := range d {
+		switch {
+		case e == 1:
+			num = append(num, baseUnits[i])
+		case e > 1:
+			num = append(num, baseUnits[i]+"^"+strconv.Itoa(int(e)))
+		case e == -1:
+			den = append(den, baseUnits[i])
+		case e < -1:
+			den = append(den, baseUnits[i]+"^"+strconv.Itoa(int(-e)))
+		}
+	}
+	out := strings.Join(num, "*")
+	if out == "" {
+		out = "1"
+	}
+	if len(den) == 1 {
+		out += "/" + den[0]
+	} else if len(den) > 1 {
+		out += "/(" + strings.Join(den, "*") + ")"
+	}
+	return out
+}
+
+/*Unit is the value of one unit in SI base units
+ */
+type Unit struct {
+	Factor float64
+	Dim    Dim
+}
+
+var Units = map[string]*Unit{
+	"m":    {1, dim(1, 0, 0, 0, 0, 0, 0)},
+	"km":   {1000, dim(1, 0, 0, 0, 0, 0, 0)},
+	"cm":   {0.01, dim(1, 0, 0, 0, 0, 0, 0)},
+	"mm":   {0.001, dim(1, 0, 0, 0, 0, 0, 0)},
+	"mi":   {1609.344, dim(1, 0, 0, 0, 0, 0, 0)},
+	"yd":   {0.9144, dim(1, 0, 0, 0, 0, 0, 0)},
+	"ft":   {0.3048, dim(1, 0, 0, 0, 0, 0, 0)},
+	"inch": {0.0254, dim(1, 0, 0, 0, 0, 0, 0)},
+	"nmi":  {1852, dim(1, 0, 0, 0, 0, 0, 0)},
+
+	"kg": {1, dim(0, 1, 0, 0, 0, 0, 0)},
+	"g":  {0.001, dim(0, 1, 0, 0, 0, 0, 0)},
+	"t":  {1000, dim(0, 1, 0, 0, 0, 0, 0)},
+	"lb": {0.45359237, dim(0, 1, 0, 0, 0, 0, 0)},
+
+	"s":   {1, dim(0, 0, 1, 0, 0, 0, 0)},
+	"ms":  {0.001, dim(0, 0, 1, 0, 0, 0, 0)},
+	"min": {60, dim(0, 0, 1, 0, 0, 0, 0)},
+	"h":   {3600, dim(0, 0, 1, 0, 0, 0, 0)},
+	"day": {86400, dim(0, 0, 1, 0, 0, 0, 0)},
+
+	"A":   {1, dim(0, 0, 0, 1, 0, 0, 0)},
+	"K":   {1, dim(0, 0, 0, 0, 1, 0, 0)},
+	"mol": {1, dim(0, 0, 0, 0, 0, 1, 0)},
+	"cd":  {1, dim(0, 0, 0, 0, 0, 0, 1)},
+
+	"L":    {0.001, dim(3, 0, 0, 0, 0, 0, 0)},
+	"Hz":   {1, dim(0, 0, -1, 0, 0, 0, 0)},
+	"N":    {1, dim(1, 1, -2, 0, 0, 0, 0)},
+	"J":    {1, dim(2, 1, -2, 0, 0, 0, 0)},
+	"W":    {1, dim(2, 1, -3, 0, 0, 0, 0)},
+	"Pa":   {1, dim(-1, 1, -2, 0, 0, 0, 0)},
+	"C":    {1, dim(0, 0, 1, 1, 0, 0, 0)},
+	"V":    {1, dim(2, 1, -3, -1, 0, 0, 0)},
+	"mph":  {1609.344 / 3600, dim(1, 0, -1, 0, 0, 0, 0)},
+	"kph":  {1000.0 / 3600, dim(1, 0, -1, 0, 0, 0, 0)},
+	"knot": {1852.0 / 3600, dim(1, 0, -1, 0, 0, 0, 0)},
+}
+
+/*RegisterUnit adds a unit worth factor times the SI base
+units with exponents given by dim
+*/
+func RegisterUnit(name string, factor float64, dim Dim) {
+	Units[name] = &Unit{
+		Factor: factor,
+		Dim:    dim,
+	}
+}
+
+/*Quantity is a number with units, V is always in SI base units.
+Unit is the text of the unit it's shown in and Scale is it's factor,
+results of operations that mix units are shown in base units
+*/
+type Quantity struct {
+	V     float64
+	Dim   Dim
+	Unit  string
+	Scale float64
+}
+
+func (q Quantity) String() string {
+	if q.Unit == "" {
+		return strconv.FormatFloat(q.V, 'g', -1, 64) + " " + q.Dim.String()
+	}
+	return strconv.FormatFloat(q.V/q.Scale, 'g', -1, 64) + " " + q.Unit
+}
+
+func toQuantity(v Value) Quantity {
+	if q, ok := v.(Quantity); ok {
+		return q
+	}
+	return Quantity{V: toFloat(v)}
+}
+
+/*unitValue returns one of the named unit, raised to exp
+ */
+func unitValue(name string, exp float64) (Quantity, error) {
+	u, ok := Units[name]
+	if !ok {
+		return Quantity{}, errors.New("Undefined unit: " + name)
+	}
+	q := Quantity{V: u.Factor, Dim: u.Dim, Unit: name, Scale: u.Factor}
+	if exp == 1 {
+		return q, nil
+	}
+	d, err := dimPow(u.Dim, exp)
+	if err != nil {
+		return Quantity{}, err
+	}
+	f := math.Pow(u.Factor, exp)
+	return Quantity{V: f, Dim: d, Unit: name + "^" + strconv.FormatFloat(exp, 'g', -1, 64), Scale: f}, nil
+}
+
+/*dimPow fails if any exponent of the result is not an integer,
+like the square root of meters
+*/
+func dimPow(d Dim, exp float64) (Dim, error) {
+	out := Dim{}
+	for i, e := range d {
+		r := float64(e) * exp
+		if r != math.Trunc(r) || math.Abs(r) > math.MaxInt8 {
+			return Dim{}, errors.New("Units with fractional exponents: (" + d.String() + ")^" + strconv.FormatFloat(exp, 'g', -1, 64))
+		}
+		out[i] = int8(r)
+	}
+	return out, nil
+}
+
+/*quantity returns a dimensionless result as a Float
+ */
+func quantity(q Quantity) Value {
+	if q.Dim.IsZero() {
+		return Float(q.V)
+	}
+	return q
+}
+
+func quantityOp(op string, a, b Quantity) (Value, error) {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if a.Dim != b.Dim {
+			return nil, errors.New("Incompatible units: " + a.Dim.String() + " " + op + " " + b.Dim.String())
+		}
+		return floatCompare(op, a.V, b.V)
+	case "+", "-", "%":
+		if a.Dim != b.Dim {
+			return nil, errors.New("Incompatible units: " + a.Dim.String() + " " + op + " " + b.Dim.String())
+		}
+		out, err := floatOp(op, a.V, b.V)
+		if err != nil {
+			return nil, err
+		}
+		q := Quantity{V: toFloat(out), Dim: a.Dim}
+		if a.Unit == b.Unit {
+			q.Unit, q.Scale = a.Unit, a.Scale
+		}
+		return quantity(q), nil
+	case "*":
+		return quantity(Quantity{V: a.V * b.V, Dim: dimAdd(a.Dim, b.Dim, 1)}), nil
+	case "/":
+		return quantity(Quantity{V: a.V / b.V, Dim: dimAdd(a.Dim, b.Dim, -1)}), nil
+	case "^":
+		if !b.Dim.IsZero() {
+			return nil, errors.New("Exponent with units: " + b.Dim.String())
+		}
+		d, err := dimPow(a.Dim, b.V)
+		if err != nil {
+			return nil, err
+		}
+		return quantity(Quantity{V: math.Pow(a.V, b.V), Dim: d}), nil
+	}
+	if bitOps[op] {
+		return nil, errors.New("Bitwise operation on a value with units: " + a.Dim.String() + " " + op + " " + b.Dim.String())
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+func quantityUnary(op string, a Quantity) (Value, error) {
+	switch op {
+	case "-":
+		a.V = -a.V
+		return a, nil
+	case "!":
+		return nil, errors.New("Factorial of a value with units: " + a.Dim.String())
+	case "~":
+		return nil, errors.New("Bitwise not of a value with units: " + a.Dim.String())
+	}
+	return nil, errors.New("Invalid operation: " + op)
+}
+
+func dimAdd(a, b Dim, sign int8) Dim {
+	for i := range a {
+		a[i] += sign * b[i]
+	}
+	return a
+}
+
+/*convert shows q in the units of u, they must have the same dimension
+ */
+func convertUnits(q, u Quantity, unit string) (Value, error) {
+	if q.Dim != u.Dim {
+		return nil, errors.New("Cannot convert " + q.Dim.String() + " to " + u.Dim.String())
+	}
+	q.Unit, q.Scale = unit, u.V
+	return q, nil
+}
+
+/*formatUnit writes an unit expression without spaces, like "km/h"
+ */
+func formatUnit(n *Node) string {
+	switch {
+	case n.tp == Tunit:
+		return n.val
+	case n.val == "^":
+		return formatUnit(n.kids[0]) + "^" + operand(n.kids[1], precSigned)
+	case n.val == "/" && len(n.kids[1].kids) > 0 && n.kids[1].val != "^":
+		return formatUnit(n.kids[0]) + "/(" + formatUnit(n.kids[1]) + ")"
+	}
+	return formatUnit(n.kids[0]) + n.val + formatUnit(n.kids[1])
+}
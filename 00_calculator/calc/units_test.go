@@ -0,0 +1,42 @@
+package calc
+
+import (
+	"strings"
+	"testing"
+)
+
+/*TestUnits runs with a variable s, which is only a unit when it's
+right after a number or written next to another unit, like "m/s"
+*/
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"3 m / 2 s", "1.5 m/s"},
+		{"10 km + 300 m", "10300 m"},
+		{"9.8 m/s^2 * 2 s", "19.6 m/s"},
+		{"60 mph in km/h", "96.56063999999999 km/h"},
+		{"3 m^2/s", "3 m^2/s"},
+		{"4 m/s", "4 m/s"},
+		{"4 m / s", "2 m"},
+	}
+	env := NewEnv()
+	if _, err := Run("s = 2", env); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		out, err := Run(test.src, env)
+		if err != nil {
+			t.Errorf("%v: %v", test.src, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("%v: got %v, wanted %v", test.src, out, test.want)
+		}
+	}
+	for _, src := range []string{"t + 1", "3 m / h", "2 * g", "min"} {
+		if _, err := Run(src, env); err == nil || !strings.Contains(err.Error(), "Undefined variable") {
+			t.Errorf("%v: got %v, wanted an undefined variable", src, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package calc
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+/*Value is the result of evaluating a node. In the default mode
+every value is a Float, in exact mode literals are read as Rat and
+only become BigFloat when a result can't be represented exactly.
+Numbers with units are Quantity, which is always float64, and
+numbers with an imaginary part are Complex, which is always complex128.
+In interval mode every number is an Interval.
+Comparisons result in a Bool, which is not a number
+*/
+type Value interface {
+	String() string
+}
+
+type Float float64
+
+func (f Float) String() string {
+	return strconv.FormatFloat(float64(f), 'g', -1, 64)
+}
+
+type Bool bool
+
+func (b Bool) String() string {
+	return strconv.FormatBool(bool(b))
+}
+
+/*Bools are the names of the boolean constants, like Consts they can't be assigned to
+ */
+var Bools = map[string]Bool{
+	"true":  true,
+	"false": false,
+}
+
+type Rat struct {
+	*big.Rat
+}
+
+func (r Rat) String() string {
+	return r.RatString()
+}
+
+type BigFloat struct {
+	*big.Float
+}
+
+func (f BigFloat) String() string {
+	digits := int(float64(f.Prec()) * math.Log10(2))
+	return f.Text('g', digits)
+}
+
+/*rank orders the kinds of numbers by how much information they keep,
+operations between two kinds are done in the one with higher rank
+*/
+func rank(v Value) int {
+	switch v.(type) {
+	case Rat:
+		return 0
+	case BigFloat:
+		return 1
+	case Interval:
+		return 3
+	case Complex:
+		return 4
+	case Quantity:
+		return 5
+	}
+	return 2
+}
+
+func promote(a, b Value, prec uint) (Value, Value) {
+	if rank(a) < rank(b) {
+		return convert(a, b, prec), b
+	}
+	if rank(b) < rank(a) {
+		return a, convert(b, a, prec)
+	}
+	return a, b
+}
+
+/*convert converts v to the same kind as target
+ */
+func convert(v, target Value, prec uint) Value {
+	switch target.(type) {
+	case BigFloat:
+		return toBigFloat(v, prec)
+	case Float:
+		return Float(toFloat(v))
+	case Interval:
+		return toInterval(v)
+	case Complex:
+		return Complex(toComplex(v))
+	case Quantity:
+		return toQuantity(v)
+	}
+	return v
+}
+
+func toFloat(v Value) float64 {
+	switch v := v.(type) {
+	case Float:
+		return float64(v)
+	case Rat:
+		out, _ := v.Float64()
+		return out
+	case BigFloat:
+		out, _ := v.Float64()
+		return out
+	case Quantity:
+		return v.V
+	case Complex:
+		if imag(v) == 0 {
+			return real(v)
+		}
+	case Interval:
+		if v.isPoint() {
+			return v.Lo
+		}
+	}
+	return math.NaN()
+}
+
+func toBigFloat(v Value, prec uint) BigFloat {
+	switch v := v.(type) {
+	case Rat:
+		return BigFloat{new(big.Float).SetPrec(prec).SetRat(v.Rat)}
+	case BigFloat:
+		return v
+	}
+	return BigFloat{new(big.Float).SetPrec(prec).SetFloat64(toFloat(v))}
+}
+
+/*toInt truncates the value towards zero, as done by "%" and "!".
+Floats are never given to it, they're converted with int()
+*/
+func toInt(v Value) *big.Int {
+	if v, ok := v.(BigFloat); ok {
+		out, _ := v.Int(nil)
+		return out
+	}
+	r := v.(Rat)
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
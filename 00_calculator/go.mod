@@ -1,3 +1,3 @@
 module calc
 
-go 1.15
+go 1.18
@@ -1,16 +1,123 @@
 package main
 
 import (
+	"calc/calc"
+	"flag"
 	"fmt"
 	"os"
 )
 
+var exact = flag.Bool("exact", false, "evaluate with big.Rat, so results are exact")
+var interval = flag.Bool("interval", false, "evaluate with intervals that contain the exact result")
+var prec = flag.Uint("prec", calc.DefaultPrec, "precision in bits of inexact results in exact mode")
+var diff = flag.String("diff", "", "print the derivative with respect to the given variable")
+var simplify = flag.Bool("simplify", false, "print the simplified expression instead of evaluating it")
+var depth = flag.Int("depth", calc.DefaultMaxDepth, "maximum depth of nested calls of user functions")
+var outBase = flag.String("o", "dec", "base of the results: dec, hex, oct or bin")
+
+var bases = map[string]int{
+	"dec": 10,
+	"hex": 16,
+	"oct": 8,
+	"bin": 2,
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: calc \"Expr\"")
+	flag.Usage = usage
+	flag.Parse()
+	env := calc.NewEnv()
+	env.Exact = *exact
+	env.Interval = *interval
+	env.Prec = *prec
+	if *exact && *interval {
+		fmt.Println("-exact and -interval can't be used together")
+		os.Exit(1)
+	}
+	env.MaxDepth = *depth
+	if _, ok := bases[*outBase]; !ok {
+		fmt.Println("Unknown output base:", *outBase)
+		os.Exit(1)
+	}
+	if flag.NArg() < 1 {
+		Repl(env, os.Stdin, os.Stdout)
+		return
+	}
+	if *diff != "" {
+		d, err := calc.DiffStr(flag.Arg(0), *diff, env)
+		if err != nil {
+			printErr(os.Stdout, flag.Arg(0), err)
+			os.Exit(1)
+		}
+		fmt.Println(calc.Format(d))
+		return
+	}
+	if *simplify {
+		root, err := calc.ParseStr(flag.Arg(0))
+		if err != nil {
+			printErr(os.Stdout, flag.Arg(0), err)
+			os.Exit(1)
+		}
+		fmt.Println(calc.Format(calc.Simplify(root, env)))
+		return
+	}
+	out, err := calc.Run(flag.Arg(0), env)
+	if err != nil {
+		printErr(os.Stdout, flag.Arg(0), err)
+		os.Exit(1)
+	}
+	s, err := show(out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(s)
+}
+
+/*show writes the value in the base given by -o, in decimal
+any value can be printed, in the other bases only integers
+*/
+func show(v calc.Value) (string, error) {
+	if *outBase == "dec" {
+		return v.String(), nil
+	}
+	return calc.FormatBase(v, bases[*outBase])
+}
+
+func usage() {
+	fmt.Println(`Usage: calc [flags] ["Expr"]
+Without an expression an interactive session is started.
+Expressions starting with "-" must come after "--".`)
+	flag.PrintDefaults()
+
+	fmt.Println(`
+Stmt ::= [ident "="] Conv
+	| ident "(" [ident {"," ident}] ")" "=" Conv
+
+Conv ::= Expr ["in" UnitExpr]
+
+Expr ::= Cond
+
+Cond ::= Or ["?" Expr ":" Expr]
 
-		fmt.Println(`
-Expr ::= Term {("+" | "-") Term}
+Or ::= And {"||" And}
+
+And ::= Not {"&&" Not}
+
+Not ::= "!" Not | Cmp
+
+Cmp ::= BitOr [("==" | "!=" | "<" | "<=" | ">" | ">=") BitOr]
+
+BitOr ::= BitXor {"|" BitXor}
+
+BitXor ::= BitAnd {"xor" BitAnd}
+
+BitAnd ::= Shift {"&" Shift}
+
+Shift ::= Sum {("<<" | ">>") Sum}
+
+Sum ::= Tol {("+" | "-") Tol}
+
+Tol ::= Term ["±" Term]
 
 Term ::= Power {( "*" | "/" | "%" ) Power}
 
@@ -18,23 +125,42 @@ Power ::= Unary { "^" Unary}
 
 Unary ::= Factor ["!"]
 
-Factor ::= "(" Expr ")"
-	| SigNum
+Factor ::= SigNum
+	| SigVar
+	| "~" Factor
 
-SigNum ::= [("+" | "-")] Num
+SigNum ::= [("+" | "-")] Num [unit ["^" Factor]]
+
+SigVar ::= [("+" | "-")] ("(" Expr ")" | "[" Expr "," Expr "]" | ident | Call)
+
+Call ::= ident "(" [Expr {"," Expr}] ")"
+
+UnitExpr ::= UnitPow {("*" | "/") UnitPow}
+
+UnitPow ::= ident ["^" Factor]
 
  - - - - - - - This is taken care by the lexer
 
-Num ::= {digits} ["." {digits}]
+Num ::= {digits} ["." {digits}] ["i"]
+	| "0x" hexdigits {hexdigits}
+	| "0o" octdigits {octdigits}
+	| "0b" ("0" | "1") {"0" | "1"}
+
+ident ::= letter {letter | digits}
+
+unit ::= ident (right after a Num)
 
 digits ::= '0' | '1' | '2' | '3' | '4' | '5' | '6' | '7' | '8' | '9'
 
+hexdigits ::= digits | 'a' | 'b' | 'c' | 'd' | 'e' | 'f' (or uppercase)
+
+octdigits ::= '0' | '1' | '2' | '3' | '4' | '5' | '6' | '7'
+
 Note:
-Operations only valid in integers ("!", "%") implicitly convert any value to integers.`)
-		os.Exit(0)
-	}
-	str := os.Args[1]
-	tks := LexStr(str)
-	root := Parse(tks)
-	fmt.Println(solve(root))
+Operations only valid in integers ("!", "%", "~" and the bitwise operators) implicitly convert any value to integers.
+Outside exact mode the bitwise operators work on 64 bit integers.
+A "!" after an operand is the factorial, anywhere else it's the logical not, and "x!=1" is "x != 1".
+In exact mode functions and constants are not exact, they're evaluated with float64.
+Complex numbers are written like 2 + 3i, and are always evaluated with complex128.
+In interval mode [a, b] and a ± b are intervals, and every literal is the smallest interval that contains it.`)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"calc/calc"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*Repl reads one statement per line and prints its value,
+variables assigned in previous lines stay in the environment
+until the input ends
+*/
+func Repl(env *calc.Env, in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(out, "> ")
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) != "" {
+			res, err := calc.Run(line, env)
+			if err == nil {
+				var s string
+				s, err = show(res)
+				if err == nil {
+					fmt.Fprintln(out, s)
+				}
+			}
+			if err != nil {
+				printErr(out, line, err)
+			}
+		}
+		fmt.Fprint(out, "> ")
+	}
+	fmt.Fprintln(out)
+}
+
+/*printErr shows where in src the error happened, if it knows
+ */
+func printErr(out io.Writer, src string, err error) {
+	var e *calc.Error
+	if errors.As(err, &e) {
+		fmt.Fprint(out, e.Caret(src))
+		return
+	}
+	fmt.Fprintln(out, err)
+}
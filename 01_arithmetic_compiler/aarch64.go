@@ -0,0 +1,210 @@
+package main
+
+import "fmt"
+
+/*A64 generates GNU as for AArch64 Linux. It only has the global allocator,
+since there are no memory operands the spilled values are loaded into
+x16 and x17, which are not allocated, and the results go through x16.
+sdiv can use any register and results in 0 when dividing by zero, so the
+divisor is checked before it
+*/
+var A64 = &Target{
+	Name:    "aarch64",
+	Regs:    a64Reg,
+	Scratch: []string{"x16", "x17"},
+	Ops:     A64Ops,
+
+	Move:     "\tmov\t%s, %s\n",
+	Load:     "\tldr\t%s, %s\n",
+	LoadLit:  "\tldr\t%s, =%s\n",
+	Store:    "\tstr\t%s, %s\n",
+	Jmp:      "\tb\t%s\n",
+	Jz:       "\tcbz\t%s, %s\n",
+	DivCheck: "\tcbz\t%s, div_zero\n",
+	Result:   "x0", // the Tail prints x0
+
+	Arg: func(idx int) string {
+		return fmt.Sprintf("[x28, #%v]", 16+8*idx)
+	},
+	Slot: func(n int) string {
+		return fmt.Sprintf("[sp, #%v]", 8*n)
+	},
+	Frame: func(slots int) string {
+		return fmt.Sprintf("\tsub\tsp, sp, #%v\n", (8*slots+15)&^15) // sp must be a multiple of 16
+	},
+
+	Allocators: []string{"global"},
+
+	Header:   A64Header,
+	Tail:     A64Tail,
+	ArgCheck: A64ArgCheck,
+	Usage:    A64Usage,
+	DivZero:  A64DivZero,
+}
+
+/*The registers preserved by calls are allocated last, x18 is reserved
+by some platforms, x28 points to the arguments, x29 and x30 are the frame
+pointer and the link register
+*/
+var a64Reg = []string{
+	"x0", "x1", "x2", "x3", "x4", "x5", "x6", "x7",
+	"x8", "x9", "x10", "x11", "x12", "x13", "x14", "x15",
+	"x19", "x20", "x21", "x22", "x23", "x24", "x25", "x26", "x27",
+}
+
+/*A64Ops has the templates of the instructions, with the destination and
+both operands, in that order. The operands of the shifts are literals
+*/
+var A64Ops = map[Operator]string{
+	ADD: "\tadd\t%[1]s, %[2]s, %[3]s\n",
+	SUB: "\tsub\t%[1]s, %[2]s, %[3]s\n",
+	MUL: "\tmul\t%[1]s, %[2]s, %[3]s\n",
+	DIV: "\tsdiv\t%[1]s, %[2]s, %[3]s\n",
+	SHL: "\tlsl\t%[1]s, %[2]s, #%[3]s\n",
+	SAR: "\tasr\t%[1]s, %[2]s, #%[3]s\n",
+	SHR: "\tlsr\t%[1]s, %[2]s, #%[3]s\n",
+
+	EQ: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, eq\n",
+	NE: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, ne\n",
+	LT: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, lt\n",
+	LE: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, le\n",
+	GT: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, gt\n",
+	GE: "\tcmp\t%[2]s, %[3]s\n\tcset\t%[1]s, ge\n",
+}
+
+/*A64Header converts the arguments in place, like the x86-64 Header,
+the kernel starts the program with sp pointing to argc, followed by argv.
+x28 keeps that address, so the argument $n is at [x28, #8+8*n]
+*/
+const A64Header = `
+	.bss
+buff:	.skip	24		// 24 byte buffer
+
+	.text
+	.global	_start
+_start:
+	mov	x28, sp		// x28 points to argc
+	ldr	x19, [x28]	// argc
+	mov	x20, #1		// argv[0] is the name of the program
+convert_loop:
+	cmp	x20, x19	// stop if there are no more arguments
+	b.ge	convert_end
+	add	x21, x28, x20, lsl #3
+	ldr	x0, [x21, #8]	// address of the string
+	bl	atoi
+	str	x0, [x21, #8]	// substitute address of string for int
+	add	x20, x20, #1
+	b	convert_loop
+convert_end:
+`
+
+/*A64Tail prints the result, which is in x0, and exits with status 0.
+atoi and itoa don't call anything, so they don't need a frame
+*/
+const A64Tail = `
+exit:
+	bl	itoa		// converts the result to string
+	mov	x2, x0		// size of the string, itoa returns the start in x1
+	mov	x0, #1		// file == stdout
+	mov	x8, #64		// write syscall
+	svc	#0
+
+	mov	x0, #0		// status 0
+	mov	x8, #93		// exit syscall
+	svc	#0
+
+// atoi takes one argument in x0:
+//	start address of a string
+// and returns one result in x0:
+//	the integer
+atoi:
+	mov	x1, #0		// result
+	mov	x2, #1		// x2 is the signal (starts as positive)
+	ldrb	w3, [x0]
+	cmp	w3, #45		// if minus sign
+	b.ne	atoi_loop
+	mov	x2, #-1		// sets the signal as negative
+	add	x0, x0, #1
+atoi_loop:
+	ldrb	w3, [x0], #1	// gets char and increments the pointer
+	cbz	w3, ret_atoi	// if end of string then return
+	sub	x3, x3, #48	// converts char to integer
+	mov	x4, #10
+	mul	x1, x1, x4	// shift decimal digit
+	add	x1, x1, x3	// adds to result
+	b	atoi_loop
+ret_atoi:
+	mul	x0, x1, x2	// applies signal
+	ret
+
+// itoa takes one argument in x0:
+//	a 64 bit integer
+// and returns two results:
+//	the size of the string in x0
+//	the start of the string in x1
+// the string is written backwards from the end of buff
+itoa:
+	ldr	x1, =buff
+	add	x3, x1, #23
+	mov	w4, #10
+	strb	w4, [x3]	// newline at the end
+	mov	w2, #43		// plus sign
+	cmp	x0, #0
+	b.ge	itoa_loop
+	mov	w2, #45		// minus sign
+	neg	x0, x0		// method only works with positive integers
+itoa_loop:
+	mov	x5, #10
+	udiv	x6, x0, x5
+	msub	x7, x6, x5, x0	// remainder
+	add	x7, x7, #48
+	strb	w7, [x3, #-1]!	// decrements and stores the digit
+	mov	x0, x6
+	cbnz	x0, itoa_loop
+	strb	w2, [x3, #-1]!	// puts sign before the digits
+	add	x0, x1, #24
+	sub	x0, x0, x3	// computes total size of string
+	mov	x1, x3
+	ret
+`
+
+const A64ArgCheck = `	ldr	x16, [x28]	// argc
+	cmp	x16, #%v
+	b.lt	usage		// not enough arguments
+`
+
+const A64Usage = `
+	.text
+usage:
+	mov	x0, #2		// file == stderr
+	ldr	x1, =usage_msg
+	ldr	x2, =usage_len
+	mov	x8, #64		// write syscall
+	svc	#0
+
+	mov	x0, #1		// status 1
+	mov	x8, #93		// exit syscall
+	svc	#0
+
+	.data
+usage_msg:	.ascii	"Usage: expected %v arguments\n"
+	.set	usage_len, . - usage_msg
+`
+
+const A64DivZero = `
+	.text
+div_zero:
+	mov	x0, #2		// file == stderr
+	ldr	x1, =div_msg
+	ldr	x2, =div_len
+	mov	x8, #64		// write syscall
+	svc	#0
+
+	mov	x0, #1		// status 1
+	mov	x8, #93		// exit syscall
+	svc	#0
+
+	.data
+div_msg:	.ascii	"Division by zero\n"
+	.set	div_len, . - div_msg
+`
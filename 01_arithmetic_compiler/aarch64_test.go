@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*TestA64 checks the code generated between the Header and the Tail, with
+3 registers, so it runs without the cross tools. The first program spills
+R1 through x16 and x17, the second divides by an argument and a literal,
+and the third jumps on a comparison and loads a literal with 64 bits
+*/
+func TestA64(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`
+		MUL $1, 2 -> R0
+		MUL $1, 3 -> R1
+		MUL $1, 5 -> R2
+		MUL $1, 7 -> R3
+		ADD R0, R1 -> R4
+		ADD R4, R2 -> R5
+		ADD R5, R3 -> R6
+		OUT R6`, `	ldr	x16, [x28]	// argc
+	cmp	x16, #2
+	b.lt	usage		// not enough arguments
+	sub	sp, sp, #16
+	ldr	x16, [x28, #16]
+	ldr	x17, =2
+	mul	x0, x16, x17
+	ldr	x16, [x28, #16]
+	ldr	x17, =3
+	mul	x16, x16, x17
+	str	x16, [sp, #0]
+	ldr	x16, [x28, #16]
+	ldr	x17, =5
+	mul	x2, x16, x17
+	ldr	x16, [x28, #16]
+	ldr	x17, =7
+	mul	x1, x16, x17
+	ldr	x17, [sp, #0]
+	add	x0, x0, x17
+	add	x0, x0, x2
+	add	x0, x0, x1
+`},
+		{`
+		DIV $1, $2 -> R0
+		DIV R0, 4 -> R1
+		OUT R1`, `	ldr	x16, [x28]	// argc
+	cmp	x16, #3
+	b.lt	usage		// not enough arguments
+	ldr	x16, [x28, #16]
+	ldr	x17, [x28, #24]
+	cbz	x17, div_zero
+	sdiv	x0, x16, x17
+	ldr	x17, =4
+	sdiv	x0, x0, x17
+`},
+		{`
+		GT $1, $2 -> R0
+		JZ R0, L0
+		MOV $1 -> R1
+		JMP L1
+		L0:
+		MOV 5000000000 -> R1
+		L1:
+		SHL R1, 3 -> R2
+		OUT R2`, `	ldr	x16, [x28]	// argc
+	cmp	x16, #3
+	b.lt	usage		// not enough arguments
+	ldr	x16, [x28, #16]
+	ldr	x17, [x28, #24]
+	cmp	x16, x17
+	cset	x0, gt
+	cbz	x0, L0
+	ldr	x0, [x28, #16]
+	b	L1
+L0:
+	ldr	x0, =5000000000
+L1:
+	lsl	x0, x0, #3
+`},
+	}
+	for _, test := range tests {
+		code, err := ParseIR(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		asm, _, _ := A64.Generate(&code, "global", 3)
+		if !strings.HasPrefix(asm, A64Header) || !strings.Contains(asm, A64Tail) {
+			t.Fatalf("%v: the Header or the Tail is missing", test.src)
+		}
+		if got := asm[len(A64Header):strings.Index(asm, A64Tail)]; got != test.want {
+			t.Errorf("%v: got\n%v\nwanted\n%v", test.src, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*tree is a random program, kept as a tree so it can be minimized,
+op is empty for numbers, arguments and names
+*/
+type tree struct {
+	op, val string
+	kids    []*tree
+}
+
+func (t *tree) String() string {
+	switch t.op {
+	case "":
+		return t.val
+	case "let":
+		return fmt.Sprintf("let %v = %v; %v", t.val, t.kids[0], t.kids[1])
+	case "neg":
+		return fmt.Sprintf("-(%v)", t.kids[0])
+	case "?":
+		return fmt.Sprintf("(%v ? %v : %v)", t.kids[0], t.kids[1], t.kids[2])
+	}
+	return fmt.Sprintf("(%v %v %v)", t.kids[0], t.op, t.kids[1])
+}
+
+func (t *tree) uses(name string) bool {
+	if t.op == "" {
+		return t.val == name
+	}
+	for _, k := range t.kids {
+		if k.uses(name) {
+			return true
+		}
+	}
+	return false
+}
+
+const nargs = 3
+
+var binOps = []string{"+", "-", "*", "/", "/", "==", "!=", "<", "<=", ">", ">="}
+
+func randTree(r *rand.Rand, depth int, names []string) *tree {
+	if depth == 0 || r.Intn(5) == 0 {
+		switch n := r.Intn(10); {
+		case n < 3 && len(names) > 0:
+			return &tree{val: names[r.Intn(len(names))]}
+		case n < 5:
+			return &tree{val: fmt.Sprint("$", 1+r.Intn(nargs))}
+		}
+		return &tree{val: strconv.Itoa(r.Intn(17))}
+	}
+	switch r.Intn(10) {
+	case 0:
+		return &tree{op: "neg", kids: []*tree{randTree(r, depth-1, names)}}
+	case 1:
+		return &tree{op: "?", kids: []*tree{randTree(r, depth-1, names), randTree(r, depth-1, names), randTree(r, depth-1, names)}}
+	}
+	op := binOps[r.Intn(len(binOps))]
+	return &tree{op: op, kids: []*tree{randTree(r, depth-1, names), randTree(r, depth-1, names)}}
+}
+
+func randProgram(r *rand.Rand) *tree {
+	lets := r.Intn(4)
+	names := []string{}
+	values := []*tree{}
+	for i := 0; i < lets; i++ {
+		values = append(values, randTree(r, 3, names))
+		names = append(names, fmt.Sprint("v", i))
+	}
+	t := randTree(r, 5, names)
+	for i := lets - 1; i >= 0; i-- {
+		t = &tree{op: "let", val: names[i], kids: []*tree{values[i], t}}
+	}
+	return t
+}
+
+/*shrinks returns the programs one step smaller than t, replacing a node
+by one of it's children or by a literal, and removing unused names
+*/
+func shrinks(t *tree) []*tree {
+	out := []*tree{}
+	switch {
+	case t.op == "let":
+		out = append(out, t.kids[0])
+		if !t.kids[1].uses(t.val) {
+			out = append(out, t.kids[1])
+		}
+	case t.op != "":
+		out = append(out, t.kids...)
+		out = append(out, &tree{val: "0"}, &tree{val: "1"})
+	case t.val == "1":
+		out = append(out, &tree{val: "0"})
+	case t.val != "0":
+		out = append(out, &tree{val: "0"}, &tree{val: "1"})
+	}
+	for i, k := range t.kids {
+		for _, s := range shrinks(k) {
+			c := *t
+			c.kids = append([]*tree{}, t.kids...)
+			c.kids[i] = s
+			out = append(out, &c)
+		}
+	}
+	return out
+}
+
+/*minimize shrinks the program while the mismatch still happens*/
+func minimize(t *tree, args []string, check func(src string, args []string) string) *tree {
+	for changed := true; changed; {
+		changed = false
+		for _, s := range shrinks(t) {
+			if check(s.String(), args) != "" {
+				t, changed = s, true
+				break
+			}
+		}
+	}
+	return t
+}
+
+/*result is the output of one of the ways to evaluate the program,
+a division by zero is a result, it must happen in all of them
+*/
+type result struct {
+	out     int
+	divZero bool
+}
+
+func (r result) String() string {
+	if r.divZero {
+		return ErrDivByZero.Error()
+	}
+	return strconv.Itoa(r.out)
+}
+
+func errResult(out int, err error) result {
+	return result{out, err == ErrDivByZero}
+}
+
+/*native runs the executable, a division by zero
+prints the error and exits with status 1
+*/
+func native(path string, args []string) (result, error) {
+	cmd := exec.Command(path, args...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	if err, ok := err.(*exec.ExitError); ok && err.ExitCode() == 1 && stderr.String() == ErrDivByZero.Error()+"\n" {
+		return result{divZero: true}, nil
+	}
+	if err != nil {
+		return result{}, fmt.Errorf("%v: %v", err, stderr)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	return result{out: n}, err
+}
+
+/*evaluator runs the program in one of the ways, the NASM output is
+only assembled if nasm and ld are installed, the executables written by
+the encoder only run on x86-64 Linux, the AArch64 output needs
+the GNU cross tools and qemu-user, and the WebAssembly wat2wasm and node
+*/
+type evaluator struct {
+	name string
+	run  func(b *Block, args []string) (result, error)
+}
+
+func optimize(b *Block, passes string) (*Block, error) {
+	if passes == "" {
+		return b, nil
+	}
+	code, err := Optimize(*b, passes, nil)
+	return &code, err
+}
+
+func evaluators(t *testing.T) []evaluator {
+	vm := func(passes string) func(b *Block, args []string) (result, error) {
+		return func(b *Block, args []string) (result, error) {
+			code, err := optimize(b, passes)
+			if err != nil {
+				return result{}, err
+			}
+			m := Machine{}
+			err = m.Run(code)
+			if err != nil || len(m.Out) != 1 {
+				return errResult(0, err), nil
+			}
+			return result{out: m.Out[0]}, nil
+		}
+	}
+	out := []evaluator{
+		{"vm", vm("")},
+		{"vm -O all", vm("all,fold,dce")},
+	}
+	dir := t.TempDir()
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		elf := func(alloc, passes string) func(b *Block, args []string) (result, error) {
+			return func(b *Block, args []string) (result, error) {
+				code, err := optimize(b, passes)
+				if err != nil {
+					return result{}, err
+				}
+				asm, _, _ := X64.Generate(code, alloc, 3)
+				e, err := Encode(asm)
+				if err != nil {
+					return result{}, err
+				}
+				bin, err := ELF(e)
+				if err != nil {
+					return result{}, err
+				}
+				path := filepath.Join(dir, "elf")
+				if err := ioutil.WriteFile(path, bin, 0755); err != nil {
+					return result{}, err
+				}
+				return native(path, args)
+			}
+		}
+		out = append(out,
+			evaluator{"elf local", elf("local", "")},
+			evaluator{"elf local -O all", elf("local", "all")},
+			evaluator{"elf global", elf("global", "")},
+			evaluator{"elf global -O all", elf("global", "all")},
+		)
+	}
+	_, errNasm := exec.LookPath("nasm")
+	_, errLd := exec.LookPath("ld")
+	if errNasm == nil && errLd == nil && runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		out = append(out, evaluator{"nasm local", func(b *Block, args []string) (result, error) {
+			asm, _, _ := X64.Generate(b, "local", 3)
+			src, obj, exe := filepath.Join(dir, "out.s"), filepath.Join(dir, "out.o"), filepath.Join(dir, "out")
+			if err := ioutil.WriteFile(src, []byte(asm), 0644); err != nil {
+				return result{}, err
+			}
+			if msg, err := exec.Command("nasm", "-felf64", src, "-o", obj).CombinedOutput(); err != nil {
+				return result{}, fmt.Errorf("nasm: %v %s", err, msg)
+			}
+			if msg, err := exec.Command("ld", obj, "-o", exe).CombinedOutput(); err != nil {
+				return result{}, fmt.Errorf("ld: %v %s", err, msg)
+			}
+			return native(exe, args)
+		}})
+	} else {
+		t.Log("nasm or ld not found, the NASM output is not tested")
+	}
+	if run, ok := aarch64(dir); ok {
+		out = append(out,
+			evaluator{"aarch64", func(b *Block, args []string) (result, error) {
+				asm, _, _ := A64.Generate(b, "global", 3)
+				return run(asm, args)
+			}},
+			evaluator{"aarch64 -O all", func(b *Block, args []string) (result, error) {
+				code, err := optimize(b, "all")
+				if err != nil {
+					return result{}, err
+				}
+				asm, _, _ := A64.Generate(code, "global", 3)
+				return run(asm, args)
+			}},
+		)
+	} else {
+		t.Log("the aarch64 assembler, linker or qemu-aarch64 not found, the aarch64 output is not tested")
+	}
+	_, errWat := exec.LookPath("wat2wasm")
+	_, errNode := exec.LookPath("node")
+	if errWat == nil && errNode == nil {
+		out = append(out, evaluator{"wasm -O all", func(b *Block, args []string) (result, error) {
+			code, err := optimize(b, "all")
+			if err != nil {
+				return result{}, err
+			}
+			return wasm(dir, WAT(*code), args)
+		}})
+	} else {
+		t.Log("wat2wasm or node not found, the WebAssembly output is not tested")
+	}
+	return out
+}
+
+/*runWasm calls main with the arguments, a trap of the
+division is reported like the native executables do
+*/
+const runWasm = `
+const fs = require("fs")
+const m = new WebAssembly.Instance(new WebAssembly.Module(fs.readFileSync(process.argv[2])), {})
+const args = process.argv.slice(3).map(BigInt)
+try {
+	console.log(m.exports.main(...args.slice(0, m.exports.main.length)).toString())
+} catch (e) {
+	if (!(e instanceof WebAssembly.RuntimeError && /divide by zero/.test(e.message))) {
+		throw e
+	}
+	process.stderr.write("Division by zero\n")
+	process.exit(1)
+}
+`
+
+func wasm(dir, wat string, args []string) (result, error) {
+	src, bin, js := filepath.Join(dir, "out.wat"), filepath.Join(dir, "out.wasm"), filepath.Join(dir, "run.js")
+	if err := ioutil.WriteFile(src, []byte(wat), 0644); err != nil {
+		return result{}, err
+	}
+	if err := ioutil.WriteFile(js, []byte(runWasm), 0644); err != nil {
+		return result{}, err
+	}
+	if msg, err := exec.Command("wat2wasm", src, "-o", bin).CombinedOutput(); err != nil {
+		return result{}, fmt.Errorf("wat2wasm: %v %s", err, msg)
+	}
+	return native("node", append([]string{js, bin}, args...))
+}
+
+/*aarch64 looks for the GNU cross assembler and linker, and runs the
+executables with qemu-user, unless the tests are already running in
+AArch64 Linux
+*/
+func aarch64(dir string) (func(asm string, args []string) (result, error), bool) {
+	as, ld, qemu := "aarch64-linux-gnu-as", "aarch64-linux-gnu-ld", []string{"qemu-aarch64", "qemu-aarch64-static"}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "arm64" {
+		as, ld, qemu = "as", "ld", nil
+	}
+	if _, err := exec.LookPath(as); err != nil {
+		return nil, false
+	}
+	if _, err := exec.LookPath(ld); err != nil {
+		return nil, false
+	}
+	emulator := ""
+	for _, q := range qemu {
+		if _, err := exec.LookPath(q); err == nil {
+			emulator = q
+			break
+		}
+	}
+	if len(qemu) > 0 && emulator == "" {
+		return nil, false
+	}
+	return func(asm string, args []string) (result, error) {
+		src, obj, exe := filepath.Join(dir, "a64.s"), filepath.Join(dir, "a64.o"), filepath.Join(dir, "a64")
+		if err := ioutil.WriteFile(src, []byte(asm), 0644); err != nil {
+			return result{}, err
+		}
+		if msg, err := exec.Command(as, src, "-o", obj).CombinedOutput(); err != nil {
+			return result{}, fmt.Errorf("%v: %v %s", as, err, msg)
+		}
+		if msg, err := exec.Command(ld, obj, "-o", exe).CombinedOutput(); err != nil {
+			return result{}, fmt.Errorf("%v: %v %s", ld, err, msg)
+		}
+		if emulator != "" {
+			return native(emulator, append([]string{exe}, args...))
+		}
+		return native(exe, args)
+	}, true
+}
+
+/*TestDifferential evaluates random programs with solve, the VM
+and the native executables, and checks that they agree
+*/
+func TestDifferential(t *testing.T) {
+	evals := evaluators(t)
+	check := func(src string, args []string) string {
+		lang_args = args
+		root := Parse(LexStr(src))
+		want := errResult(Solve(root))
+		b := (&CodeGen{}).Generate(root)
+		for _, e := range evals {
+			got, err := e.run(b, args)
+			if err != nil {
+				return fmt.Sprintf("%v failed: %v", e.name, err)
+			}
+			if got != want {
+				return fmt.Sprintf("solve gives %v, %v gives %v", want, e.name, got)
+			}
+		}
+		return ""
+	}
+
+	r := rand.New(rand.NewSource(1))
+	n := 300
+	if testing.Short() {
+		n = 30
+	}
+	for i := 0; i < n; i++ {
+		prog := randProgram(r)
+		args := make([]string, nargs)
+		for j := range args {
+			args[j] = strconv.Itoa(r.Intn(21) - 10)
+		}
+		if msg := check(prog.String(), args); msg != "" {
+			min := minimize(prog, args, check)
+			t.Fatalf("%v\nprogram: %v\nargs: %v\nminimized: %v\n%v", msg, prog, args, min, check(min.String(), args))
+		}
+	}
+}
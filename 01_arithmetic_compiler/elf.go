@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+/*The executable is loaded at textAddr, the ELF header and the program
+headers are loaded with the code, so the text starts right after them
+*/
+const (
+	textAddr   = 0x400000
+	dataAddr   = 0x600000
+	pageSize   = 0x1000
+	elfHeader  = 64
+	progHeader = 56
+)
+
+/*ELF links the code and writes a static ELF64 executable, with one
+segment for the text and other for the data and bss, which are not
+executable. Every symbol is resolved by the Encoder, so there are no
+sections, symbol tables or relocations, just what the kernel needs to load it
+*/
+func ELF(e *Encoder) ([]byte, error) {
+	textOff := elfHeader + 2*progHeader
+	dataOff := (textOff + len(e.Text) + 15) &^ 15
+	// the offset in the file and the address must be the same modulo the page size
+	dataStart := dataAddr + dataOff%pageSize
+	err := e.Link(map[string]int{
+		".text": textAddr + textOff,
+		".data": dataStart,
+		".bss":  dataStart + len(e.Data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	start, ok := e.Symbols["_start"]
+	if !ok || start.Section != ".text" {
+		return nil, fmt.Errorf("_start is not defined")
+	}
+
+	out := &bytes.Buffer{}
+	w := func(data ...interface{}) {
+		for _, d := range data {
+			binary.Write(out, binary.LittleEndian, d)
+		}
+	}
+	out.Write([]byte{0x7F, 'E', 'L', 'F', 2, 1, 1, 0}) // 64 bits, little endian, version 1, System V
+	out.Write(make([]byte, 8))
+	w(uint16(2), uint16(0x3E), uint32(1))                                  // executable, x86-64, version 1
+	w(uint64(textAddr+textOff+start.Offset), uint64(elfHeader), uint64(0)) // entry, program headers, no sections
+	w(uint32(0), uint16(elfHeader), uint16(progHeader), uint16(2))         // flags, sizes and number of program headers
+	w(uint16(64), uint16(0), uint16(0))                                    // no section headers
+
+	const load, x, wr, r = 1, 1, 2, 4
+	text := uint64(textOff + len(e.Text))
+	w(uint32(load), uint32(r|x), uint64(0), uint64(textAddr), uint64(textAddr), text, text, uint64(pageSize))
+	data := uint64(len(e.Data))
+	w(uint32(load), uint32(r|wr), uint64(dataOff), uint64(dataStart), uint64(dataStart), data, data+uint64(e.Bss), uint64(pageSize))
+
+	out.Write(e.Text)
+	out.Write(make([]byte, dataOff-out.Len()))
+	out.Write(e.Data)
+	return out.Bytes(), nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+/*Graph is the interference graph, there's an edge between two virtual
+registers if they can't share a physical register. Forbid has the physical
+registers each value can't use, Moves the values copied to each other,
+which would like to share a register, and Cost counts the uses and definitions
+*/
+type Graph struct {
+	Nodes  []string
+	Adj    map[string]map[string]bool
+	Forbid map[string]map[int]bool
+	Moves  map[string][]string
+	Cost   map[string]int
+}
+
+func (g *Graph) node(v string) {
+	if _, ok := g.Adj[v]; ok {
+		return
+	}
+	g.Nodes = append(g.Nodes, v)
+	g.Adj[v] = map[string]bool{}
+	g.Forbid[v] = map[int]bool{}
+}
+
+func (g *Graph) edge(a, b string) {
+	if a != b {
+		g.Adj[a][b] = true
+		g.Adj[b][a] = true
+	}
+}
+
+/*Interference builds the graph from the liveness. A definition interferes
+with everything live after it, except the source of a MOV, and with the
+second operand, since on two address targets the first one is moved to the
+destination before the second is read. Division uses the registers in div,
+RAX and RDX in x86-64, so the divisor and the values live across a division
+can't be in them
+*/
+func Interference(lv *Liveness, div []int) *Graph {
+	g := &Graph{
+		Adj:    map[string]map[string]bool{},
+		Forbid: map[string]map[int]bool{},
+		Moves:  map[string][]string{},
+		Cost:   map[string]int{},
+	}
+	for _, bb := range lv.Blocks {
+		for _, ins := range bb {
+			for _, op := range append(ins.Uses(), ins.Def()) {
+				if isVReg(op) {
+					g.node(op.String())
+					g.Cost[op.String()]++
+				}
+			}
+		}
+	}
+	lv.Walk(func(ins *Instr, live map[string]bool) {
+		d := ins.Def()
+		if ins.Op == DIV {
+			for v := range live {
+				if v != d.String() {
+					for _, r := range div {
+						g.Forbid[v][r] = true
+					}
+				}
+			}
+			if isVReg(ins.b) {
+				for _, r := range div {
+					g.Forbid[ins.b.String()][r] = true
+				}
+			}
+		}
+		if !isVReg(d) {
+			return
+		}
+		for v := range live {
+			if ins.Op != MOV || v != ins.a.String() {
+				g.edge(d.String(), v)
+			}
+		}
+		if ins.c != nil && isVReg(ins.b) {
+			g.edge(d.String(), ins.b.String())
+		}
+		if ins.Op == MOV && isVReg(ins.a) {
+			g.Moves[d.String()] = append(g.Moves[d.String()], ins.a.String())
+			g.Moves[ins.a.String()] = append(g.Moves[ins.a.String()], d.String())
+		}
+	})
+	return g
+}
+
+/*Color assigns one of k colors to each node, the colors are indices in Target.Regs.
+Nodes with less than k neighbours can always be colored, so they're removed
+from the graph first, and when there are none left the node with the lowest
+cost per neighbour is removed as a spill candidate. Nodes are colored in the
+reverse order, candidates that still find a color are not spilled (Briggs),
+and a node takes the color of a value moved to or from it when it can.
+The nodes without a color are the ones spilled
+*/
+func (g *Graph) Color(k int) map[string]int {
+	degree := map[string]int{}
+	removed := map[string]bool{}
+	for _, v := range g.Nodes {
+		degree[v] = len(g.Adj[v])
+	}
+	stack := []string{}
+	for len(stack) < len(g.Nodes) {
+		pick := ""
+		for _, v := range g.Nodes {
+			if !removed[v] && degree[v] < k {
+				pick = v
+				break
+			}
+		}
+		if pick == "" {
+			best := math.Inf(1)
+			for _, v := range g.Nodes {
+				cost := float64(g.Cost[v]) / float64(degree[v]+1)
+				if !removed[v] && cost < best {
+					pick, best = v, cost
+				}
+			}
+		}
+		removed[pick] = true
+		stack = append(stack, pick)
+		for u := range g.Adj[pick] {
+			degree[u]--
+		}
+	}
+
+	colors := map[string]int{}
+	for i := len(stack) - 1; i >= 0; i-- {
+		v := stack[i]
+		used := map[int]bool{}
+		for c := range g.Forbid[v] {
+			used[c] = true
+		}
+		for u := range g.Adj[v] {
+			if c, ok := colors[u]; ok {
+				used[c] = true
+			}
+		}
+		color := -1
+		for _, u := range g.Moves[v] {
+			if c, ok := colors[u]; ok && c < k && !used[c] {
+				color = c
+				break
+			}
+		}
+		for c := 0; c < k && color < 0; c++ {
+			if !used[c] {
+				color = c
+			}
+		}
+		if color >= 0 {
+			colors[v] = color
+		}
+	}
+	return colors
+}
+
+/*GlobalAllocator allocates registers for the whole Block at once, using
+liveness analysis and graph coloring, and generates the code with the
+templates of the Target. Spilled values stay in the stack, if the target
+has memory operands they're used directly and the only register needed for
+them is the scratch, used when a spilled value is written, otherwise they're
+loaded into the scratch registers. Literals that don't fit in 32 bits are
+also kept in the stack when they're memory operands
+*/
+type GlobalAllocator struct {
+	t    *Target
+	in   *Block
+	Regs int // physical registers available, the first ones of t.Regs
+	out  string
+
+	Colors  map[string]int // virtual register -> physical register
+	Address map[string]int // spilled virtual registers and literals -> stack slot
+	slots   int
+	scratch []string // registers used for spilled values
+
+	Stores, Loads int // memory accesses to spilled values
+}
+
+/*Begin colors the graph with every register, if something is spilled
+and the target has no Scratch it colors again keeping the last register
+*/
+func (g *GlobalAllocator) Begin() string {
+	graph := Interference(Live(*g.in), g.t.Div)
+	g.Colors = graph.Color(g.Regs)
+	g.scratch = g.t.Scratch
+	if len(g.Colors) < len(graph.Nodes) && len(g.scratch) == 0 {
+		g.scratch = []string{g.t.Regs[g.Regs-1]}
+		g.Colors = graph.Color(g.Regs - 1)
+	}
+	g.Address = map[string]int{}
+	g.slots = 0
+	for _, v := range graph.Nodes {
+		if _, ok := g.Colors[v]; !ok {
+			g.slot(v)
+		}
+	}
+
+	g.out = ""
+	for _, ins := range *g.in {
+		g.gen(ins)
+	}
+
+	frame := ""
+	if g.slots > 0 {
+		frame = g.t.Frame(g.slots)
+	}
+	for _, v := range sorted(g.consts()) { // literals are stored before they're used
+		frame += fmt.Sprintf(g.t.LoadLit, g.t.Regs[0], v)
+		frame += fmt.Sprintf(g.t.Store, g.t.Regs[0], g.t.Slot(g.Address[v]))
+	}
+	return g.t.Assemble(g.in, frame, g.out)
+}
+
+func (g *GlobalAllocator) slot(key string) int {
+	if n, ok := g.Address[key]; ok {
+		return n
+	}
+	g.Address[key] = g.slots
+	g.slots++
+	return g.Address[key]
+}
+
+func (g *GlobalAllocator) consts() map[string]bool {
+	out := map[string]bool{}
+	for key := range g.Address {
+		if !isTemp(key) {
+			out[key] = true
+		}
+	}
+	return out
+}
+
+/*operand returns the operand on targets with memory operands, a register,
+an immediate or a memory address. Literals that can't be immediates are
+read from the stack
+*/
+func (g *GlobalAllocator) operand(op *Operand, imm bool) string {
+	switch op.Type {
+	case tNUMB:
+		if imm && isImm32(op.Data) {
+			return op.Data
+		}
+		return g.t.Slot(g.slot(op.Data))
+	case tARGU:
+		return g.t.Arg(LangArgToIndex(op.Data))
+	}
+	if c, ok := g.Colors[op.String()]; ok {
+		return g.t.Regs[c]
+	}
+	g.Loads++
+	return g.t.Slot(g.Address[op.String()])
+}
+
+/*source returns the operand as the target reads it, in memory
+or as an immediate if it can, otherwise in a register
+*/
+func (g *GlobalAllocator) source(op *Operand, imm bool) string {
+	if g.t.Mem {
+		return g.operand(op, imm)
+	}
+	return g.reg(op, g.scratch[0])
+}
+
+/*reg returns the register with the value of the operand,
+the values that are not in registers are loaded into scratch
+*/
+func (g *GlobalAllocator) reg(op *Operand, scratch string) string {
+	if c, ok := g.Colors[op.String()]; ok {
+		return g.t.Regs[c]
+	}
+	g.load(scratch, op)
+	return scratch
+}
+
+/*dest returns the register where the result is computed, and
+the store needed after it if the result is spilled
+*/
+func (g *GlobalAllocator) dest(op *Operand) (string, string) {
+	if c, ok := g.Colors[op.String()]; ok {
+		return g.t.Regs[c], ""
+	}
+	return g.scratch[0], g.store(g.scratch[0], op)
+}
+
+func (g *GlobalAllocator) store(src string, op *Operand) string {
+	g.Stores++
+	return fmt.Sprintf(g.t.Store, src, g.t.Slot(g.Address[op.String()]))
+}
+
+func (g *GlobalAllocator) mov(dst, src string) {
+	if dst != src {
+		g.out += fmt.Sprintf(g.t.Move, dst, src)
+	}
+}
+
+/*load moves the operand to the register, literals
+are loaded with LoadLit since they can have 64 bits
+*/
+func (g *GlobalAllocator) load(reg string, op *Operand) {
+	if op.Type == tNUMB {
+		g.out += fmt.Sprintf(g.t.LoadLit, reg, op.Data)
+		return
+	}
+	if c, ok := g.Colors[op.String()]; ok {
+		g.mov(reg, g.t.Regs[c])
+		return
+	}
+	g.out += fmt.Sprintf(g.t.Load, reg, g.operand(op, false))
+}
+
+/*template formats the template of the operation, the low
+byte is only used by the comparisons of x86-64
+*/
+func (g *GlobalAllocator) template(op Operator, d, a, b string) string {
+	low := ""
+	for i, r := range g.t.Regs {
+		if r == d && i < len(g.t.Low) {
+			low = g.t.Low[i]
+		}
+	}
+	return fmt.Sprintf(g.t.Ops[op], d, a, b, low)
+}
+
+func (g *GlobalAllocator) gen(ins *Instr) {
+	switch ins.Op {
+	case LABEL:
+		g.out += ins.a.Data + ":\n"
+	case JMP:
+		g.out += fmt.Sprintf(g.t.Jmp, ins.a.Data)
+	case JZ:
+		if ins.a.Type == tNUMB { // the jump is known at compile time
+			if StrToFloat(ins.a.Data) == 0 {
+				g.out += fmt.Sprintf(g.t.Jmp, ins.b.Data)
+			}
+			return
+		}
+		g.out += fmt.Sprintf(g.t.Jz, g.source(ins.a, false), ins.b.Data)
+	case OUT:
+		if g.t.Out == "" {
+			g.load(g.t.Result, ins.a)
+			return
+		}
+		g.out += fmt.Sprintf(g.t.Out, g.source(ins.a, true))
+	case MOV:
+		if c, ok := g.Colors[ins.b.String()]; ok {
+			g.load(g.t.Regs[c], ins.a)
+			return
+		}
+		src := ""
+		if c, ok := g.Colors[ins.a.String()]; ok {
+			src = g.t.Regs[c]
+		} else if g.t.Mem && ins.a.Type == tNUMB && isImm32(ins.a.Data) {
+			src = ins.a.Data
+		} else {
+			src = g.scratch[0]
+			g.load(src, ins.a)
+		}
+		g.out += g.store(src, ins.b)
+	case DIV:
+		if len(g.t.Div) == 0 {
+			g.genOp(ins)
+			return
+		}
+		q := g.t.Regs[g.t.Div[0]]
+		g.load(q, ins.a)
+		divisor := g.source(ins.b, false)
+		if needsCheck(ins.b) {
+			g.out += fmt.Sprintf(g.t.DivCheck, divisor)
+		}
+		g.out += g.template(DIV, q, q, divisor)
+		if c, ok := g.Colors[ins.c.String()]; ok {
+			g.mov(g.t.Regs[c], q)
+			return
+		}
+		g.out += g.store(q, ins.c)
+	default:
+		g.genOp(ins)
+	}
+}
+
+/*genOp generates ADD, SUB, MUL, the shifts, whose second
+operand is a literal, the comparisons and DIV if it doesn't use
+fixed registers
+*/
+func (g *GlobalAllocator) genOp(ins *Instr) {
+	d, store := g.dest(ins.c)
+	a := d
+	if g.t.TwoAddress {
+		g.load(d, ins.a)
+	} else {
+		a = g.reg(ins.a, g.scratch[0])
+	}
+	b := ""
+	switch {
+	case ins.b.Type == tNUMB && (ins.Op == SHL || ins.Op == SAR || ins.Op == SHR):
+		b = ins.b.Data
+	case g.t.Mem:
+		b = g.operand(ins.b, true)
+	default:
+		b = g.reg(ins.b, g.scratch[1])
+	}
+	if ins.Op == DIV && needsCheck(ins.b) {
+		g.out += fmt.Sprintf(g.t.DivCheck, b)
+	}
+	g.out += g.template(ins.Op, d, a, b) + store
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*ParseIR reads the 3 address code in the format printed by Block.String,
+so the VM and the allocators can be used without the expression front end.
+The "block {" and "}" around the code are optional, and everything after
+a ';' is a comment:
+
+	MUL $1, 4 -> R0 ; operation a, b -> destination
+	JZ R0, L0
+	MOV R0 -> R1
+	L0:
+	OUT R1
+
+Registers are R followed by a number, arguments $ followed by a number,
+labels L followed by a number, like the ones generated, so they don't clash
+with the labels of the runtime, and literals are decimal integers.
+Besides the syntax, it checks these rules:
+
+	Registers are written before they're read.
+	No instruction reads the register it writes, the local allocator
+	takes the register of the destination before reading the operands.
+	Jumps go forward to labels that exist, since the optimizations
+	and the local allocator assume there are no loops.
+	The code ends with the only OUT, the program prints a single result.
+*/
+func ParseIR(src string) (Block, error) {
+	code := Block{}
+	lines := []int{} // line of each instruction
+	labels := map[string]bool{}
+	for i, line := range strings.Split(src, "\n") {
+		if c := strings.Index(line, ";"); c >= 0 {
+			line = line[:c]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line == "block {" || line == "}" {
+			continue
+		}
+		ins, err := parseInstr(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v: %q", i+1, err, line)
+		}
+		if ins.Op == LABEL {
+			if labels[ins.a.Data] {
+				return nil, fmt.Errorf("line %v: label %v already defined", i+1, ins.a.Data)
+			}
+			labels[ins.a.Data] = true
+		}
+		code = append(code, ins)
+		lines = append(lines, i+1)
+	}
+	if len(code) == 0 || code[len(code)-1].Op != OUT {
+		return nil, fmt.Errorf("the code must end with OUT")
+	}
+	seen := map[string]bool{}
+	for i, ins := range code {
+		for _, op := range ins.Uses() {
+			if d := ins.Def(); isVReg(d) && op.String() == d.String() {
+				return nil, fmt.Errorf("line %v: %v is read and written by the same instruction", lines[i], d)
+			}
+		}
+		target := ""
+		switch ins.Op {
+		case LABEL:
+			seen[ins.a.Data] = true
+		case JMP:
+			target = ins.a.Data
+		case JZ:
+			target = ins.b.Data
+		}
+		switch {
+		case ins.Op == OUT && i != len(code)-1:
+			return nil, fmt.Errorf("OUT must be the last instruction")
+		case target != "" && !labels[target]:
+			return nil, fmt.Errorf("%v jumps to a label that doesn't exist", strings.TrimSpace(ins.String()))
+		case target != "" && seen[target]:
+			return nil, fmt.Errorf("%v jumps backwards", strings.TrimSpace(ins.String()))
+		}
+	}
+	if in := Live(code).In; len(in) > 0 && len(in[0]) > 0 {
+		return nil, fmt.Errorf("registers read before they're written: %v", strings.Join(sorted(in[0]), ", "))
+	}
+	return code, nil
+}
+
+func parseInstr(line string) (*Instr, error) {
+	if strings.HasSuffix(line, ":") {
+		l, err := parseIROperand(strings.TrimSuffix(line, ":"))
+		if err != nil || l.Type != tLABL {
+			return nil, fmt.Errorf("expected a label")
+		}
+		return &Instr{Op: LABEL, a: l}, nil
+	}
+	fields := strings.Fields(line)
+	op, ok := StrToOp(fields[0])
+	if !ok || op == LABEL {
+		return nil, fmt.Errorf("unknown operation %v", fields[0])
+	}
+	rest := strings.TrimSpace(line[len(fields[0]):])
+
+	var dst *Operand
+	if i := strings.Index(rest, "->"); i >= 0 {
+		d, err := parseIROperand(strings.TrimSpace(rest[i+2:]))
+		if err != nil {
+			return nil, err
+		}
+		if d.Type != tREGI {
+			return nil, fmt.Errorf("the destination must be a register")
+		}
+		dst, rest = d, strings.TrimSpace(rest[:i])
+	}
+	ops := []*Operand{}
+	for _, s := range strings.Split(rest, ",") {
+		o, err := parseIROperand(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, o)
+	}
+
+	ins := &Instr{Op: op}
+	switch op {
+	case JMP:
+		if len(ops) != 1 || dst != nil || ops[0].Type != tLABL {
+			return nil, fmt.Errorf("expected JMP label")
+		}
+		ins.a = ops[0]
+	case JZ:
+		if len(ops) != 2 || dst != nil || ops[0].Type == tLABL || ops[1].Type != tLABL {
+			return nil, fmt.Errorf("expected JZ value, label")
+		}
+		ins.a, ins.b = ops[0], ops[1]
+	case OUT:
+		if len(ops) != 1 || dst != nil || ops[0].Type == tLABL {
+			return nil, fmt.Errorf("expected OUT value")
+		}
+		ins.a = ops[0]
+	case MOV:
+		if len(ops) != 1 || dst == nil || ops[0].Type == tLABL {
+			return nil, fmt.Errorf("expected MOV value -> register")
+		}
+		ins.a, ins.b = ops[0], dst
+	default:
+		if len(ops) != 2 || dst == nil || ops[0].Type == tLABL || ops[1].Type == tLABL {
+			return nil, fmt.Errorf("expected %v value, value -> register", fields[0])
+		}
+		if (op == SHL || op == SAR || op == SHR) && !isShift(ops[1]) {
+			return nil, fmt.Errorf("shifts must be by a literal from 0 to 63")
+		}
+		ins.a, ins.b, ins.c = ops[0], ops[1], dst
+	}
+	return ins, nil
+}
+
+func isShift(op *Operand) bool {
+	n, err := strconv.Atoi(op.Data)
+	return op.Type == tNUMB && err == nil && n >= 0 && n <= 63
+}
+
+/*StrToOp is the inverse of OpToStr*/
+func StrToOp(s string) (Operator, bool) {
+	for op, name := range OpToStr {
+		if name == s {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+func parseIROperand(s string) (*Operand, error) {
+	isNum := func(s string) bool {
+		_, err := strconv.ParseInt(s, 10, 64)
+		return err == nil
+	}
+	switch {
+	case strings.HasPrefix(s, "R") && isNum(s[1:]) && !strings.ContainsAny(s[1:], "+-"):
+		n, _ := strconv.Atoi(s[1:])
+		return &Operand{Data: strconv.Itoa(n), Type: tREGI}, nil
+	case strings.HasPrefix(s, "$"):
+		n, err := strconv.Atoi(s[1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid argument %v, expected a number from 1 after $", s)
+		}
+		return &Operand{Data: "$" + strconv.Itoa(n), Type: tARGU}, nil
+	case isNum(s):
+		n, _ := strconv.ParseInt(s, 10, 64)
+		return &Operand{Data: strconv.FormatInt(n, 10), Type: tNUMB}, nil
+	case strings.HasPrefix(s, "L") && isNum(s[1:]) && !strings.ContainsAny(s[1:], "+-"):
+		return &Operand{Data: s, Type: tLABL}, nil
+	}
+	return nil, fmt.Errorf("invalid operand %q", s)
+}
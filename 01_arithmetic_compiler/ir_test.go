@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+/*TestIRRoundTrip parses the code generated for random programs,
+before and after the optimizations, and checks it prints the same
+*/
+func TestIRRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		prog := randProgram(r)
+		b := (&CodeGen{}).Generate(Parse(LexStr(prog.String())))
+		opt, err := Optimize(*b, "all", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, code := range []Block{*b, opt} {
+			got, err := ParseIR(code.String())
+			if err != nil {
+				t.Fatalf("%v: %v\n%v", prog, err, code)
+			}
+			if got.String() != code.String() {
+				t.Fatalf("%v: got\n%v\nwanted\n%v", prog, got, code)
+			}
+		}
+	}
+}
+
+func TestIRErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"ADD R0, 1 -> R1\nOUT R1", "read before they're written: R0"},
+		{"JZ 1, L0\nMOV 2 -> R0\nL0:\nOUT R0", "read before they're written: R0"},
+		{"L0:\nJMP L0\nOUT 1", "jumps backwards"},
+		{"JMP L3\nOUT 1", "doesn't exist"},
+		{"L0:\nL0:\nOUT 1", "already defined"},
+		{"ADD 1, 2 -> 5\nOUT 1", "destination must be a register"},
+		{"ADD 1 -> R0\nOUT R0", "expected ADD value, value -> register"},
+		{"SHL 1, R0 -> R1\nOUT R1", "shifts must be by a literal"},
+		{"FOO 1\nOUT 1", "unknown operation"},
+		{"MOV $0 -> R0\nOUT R0", "invalid argument"},
+		{"OUT exit", "invalid operand"},
+		{"OUT 1\nOUT 2", "OUT must be the last"},
+		{"MOV 1 -> R0", "must end with OUT"},
+		{"MOV 1 -> R0\nADD R0, $1 -> R0\nMUL R0, R0 -> R0\nOUT R0", "line 2: R0 is read and written by the same instruction"},
+		{"MOV 1 -> R0\nJZ $1, L0\nL0:\nDIV 4, R0 -> R0\nOUT R0", "line 4: R0 is read and written by the same instruction"},
+	}
+	for _, test := range tests {
+		_, err := ParseIR(test.src)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got %v, wanted an error with %q", test.src, err, test.err)
+		}
+	}
+}
+
+/*TestIRRewrites runs hand written code that writes registers again,
+which the generated code never does, with every evaluator
+*/
+func TestIRRewrites(t *testing.T) {
+	tests := []struct {
+		src  string
+		args []string
+		want int
+	}{
+		{"MOV 2 -> R0\nADD $1, R0 -> R1\nMOV 3 -> R0\nADD $1, R0 -> R2\nOUT R2", []string{"5"}, 8},
+		{"MOV 1 -> R0\nADD R0, $1 -> R1\nMUL R1, R1 -> R0\nOUT R0", []string{"5"}, 36},
+		{"MOV $1 -> R0\nJZ $2, L0\nDIV R0, 2 -> R1\nMOV R1 -> R0\nL0:\nMUL R0, 3 -> R1\nSUB R1, R0 -> R2\nOUT R2", []string{"7", "1"}, 6},
+		{"MOV $1 -> R0\nJZ $2, L0\nDIV R0, 2 -> R1\nMOV R1 -> R0\nL0:\nMUL R0, 3 -> R1\nSUB R1, R0 -> R2\nOUT R2", []string{"7", "0"}, 14},
+	}
+	evals := evaluators(t)
+	for _, test := range tests {
+		code, err := ParseIR(test.src)
+		if err != nil {
+			t.Fatalf("%q: %v", test.src, err)
+		}
+		lang_args = test.args
+		for _, e := range evals {
+			got, err := e.run(&code, test.args)
+			if err != nil {
+				t.Fatalf("%q: %v failed: %v", test.src, e.name, err)
+			}
+			if got != (result{out: test.want}) {
+				t.Errorf("%q %v: %v gives %v, wanted %v", test.src, test.args, e.name, got, test.want)
+			}
+		}
+	}
+}
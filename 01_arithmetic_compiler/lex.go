@@ -20,6 +20,8 @@ const (
 	Tnum lexType = iota
 	Targ
 	Tope
+	Tid
+	Tkey
 	Teof
 )
 
@@ -30,6 +32,8 @@ var printMap = map[lexType]string{
 	Tnum: "int",
 	Tope: "ope",
 	Targ: "arg",
+	Tid:  "id",
+	Tkey: "key",
 	Teof: "EOF",
 }
 
@@ -113,20 +117,40 @@ func any(l *Lexer) lexState {
 	case ' ', '\n', '\t':
 		l.ignore()
 		return any
-	case '$':
-		l.accept("123456789")
+	case '$': // $1, $2, ..., $10, ...
+		if !l.accept("123456789") {
+			log.Fatalf("Invalid argument, expected a number from 1 after $")
+		}
+		l.acceptRun("0123456789")
 		l.emit(Targ)
 		return any
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 		l.unread()
 		return number
-	case '+', '-', '/', '*', '(', ')':
+	case '+', '-', '/', '*', '(', ')', '?', ':', ';':
+		l.emit(Tope)
+		return any
+	case '<', '>': // "<=", "<", ">=" and ">"
+		l.accept("=")
+		l.emit(Tope)
+		return any
+	case '=': // "==" and "="
+		l.accept("=")
+		l.emit(Tope)
+		return any
+	case '!': // only "!="
+		if !l.accept("=") {
+			log.Fatalf("Invalid rune: %v, did you mean !=?", string(r))
+		}
 		l.emit(Tope)
 		return any
 	case eof:
 		l.emit(Teof)
 		return nil
 	default:
+		if isLetter(r) {
+			return ident
+		}
 		log.Fatalf("Invalid rune: %v", string(r))
 		return nil
 	}
@@ -137,3 +161,23 @@ func number(l *Lexer) lexState {
 	l.emit(Tnum)
 	return any
 }
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
+
+func isLetter(r rune) bool {
+	return strings.ContainsRune(letters, r)
+}
+
+var keywords = map[string]bool{
+	"let": true,
+}
+
+func ident(l *Lexer) lexState {
+	l.acceptRun(letters + "0123456789")
+	if keywords[l.s[l.start:l.end]] {
+		l.emit(Tkey)
+		return any
+	}
+	l.emit(Tid)
+	return any
+}
@@ -14,6 +14,24 @@ const (
 	MUL
 	DIV
 	SUB
+
+	// shifts by a literal, SAR keeps the sign and SHR fills with zeros
+	SHL
+	SAR
+	SHR
+
+	// comparisons result in 1 or 0
+	EQ
+	NE
+	LT
+	LE
+	GT
+	GE
+
+	// control flow, the operands are labels
+	LABEL
+	JMP
+	JZ // jumps if the first operand is zero
 )
 
 var OpToStr = map[Operator]string{
@@ -24,13 +42,34 @@ var OpToStr = map[Operator]string{
 	MUL: "MUL",
 	DIV: "DIV",
 	SUB: "SUB",
+
+	SHL: "SHL",
+	SAR: "SAR",
+	SHR: "SHR",
+
+	EQ: "EQ",
+	NE: "NE",
+	LT: "LT",
+	LE: "LE",
+	GT: "GT",
+	GE: "GE",
+
+	LABEL: "LABEL",
+	JMP:   "JMP",
+	JZ:    "JZ",
 }
 
 var SymbToOp = map[string]Operator{
-	"+": ADD,
-	"*": MUL,
-	"/": DIV,
-	"-": SUB,
+	"+":  ADD,
+	"*":  MUL,
+	"/":  DIV,
+	"-":  SUB,
+	"==": EQ,
+	"!=": NE,
+	"<":  LT,
+	"<=": LE,
+	">":  GT,
+	">=": GE,
 }
 
 type OpType int
@@ -40,6 +79,7 @@ const (
 	tADDR
 	tNUMB
 	tARGU
+	tLABL
 )
 
 type Operand struct {
@@ -60,6 +100,12 @@ type Instr struct {
 }
 
 func (i *Instr) String() string {
+	switch i.Op {
+	case LABEL:
+		return fmt.Sprintf("%v:\n", i.a)
+	case JZ:
+		return fmt.Sprintf("%s %v, %v\n", OpToStr[i.Op], i.a, i.b)
+	}
 	if i.c != nil {
 		return fmt.Sprintf("%s %v, %v -> %v\n", OpToStr[i.Op], i.a, i.b, i.c)
 	}
@@ -69,8 +115,76 @@ func (i *Instr) String() string {
 	return fmt.Sprintf("%s %v\n", OpToStr[i.Op], i.a)
 }
 
+/*Uses returns the operands read by the instruction,
+labels and the destination are not included
+*/
+func (i *Instr) Uses() []*Operand {
+	switch {
+	case i.Op == LABEL || i.Op == JMP:
+		return nil
+	case i.c != nil:
+		return []*Operand{i.a, i.b}
+	}
+	return []*Operand{i.a} // MOV, OUT and JZ
+}
+
+/*Def returns the operand written by the instruction, or nil
+ */
+func (i *Instr) Def() *Operand {
+	switch {
+	case i.c != nil:
+		return i.c
+	case i.Op == MOV:
+		return i.b
+	}
+	return nil
+}
+
+/*IsJump is true for the instructions that end a basic block
+ */
+func (i *Instr) IsJump() bool {
+	return i.Op == JMP || i.Op == JZ
+}
+
 type Block []*Instr
 
+/*MaxArg returns the highest argument used, $3 is 3,
+the program needs at least that many arguments
+*/
+func (b Block) MaxArg() int {
+	max := 0
+	for _, ins := range b {
+		for _, op := range ins.Uses() {
+			if op.Type == tARGU && LangArgToIndex(op.Data)+1 > max {
+				max = LangArgToIndex(op.Data) + 1
+			}
+		}
+	}
+	return max
+}
+
+/*BasicBlocks splits the code in sequences that are always executed
+from the start to the end, they start at labels and end after jumps
+*/
+func (b Block) BasicBlocks() []Block {
+	out := []Block{}
+	start := 0
+	for i, ins := range b {
+		if ins.Op == LABEL && i > start {
+			out = append(out, b[start:i])
+			start = i
+		}
+		if ins.IsJump() {
+			out = append(out, b[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		out = append(out, b[start:])
+	}
+	return out
+}
+
 func (b Block) String() string {
 	out := "block {\n"
 	for i := range b {
@@ -82,12 +196,16 @@ func (b Block) String() string {
 
 type CodeGen struct {
 	Counter int
+	Labels  int
 	Code    *Block
+	Vars    map[string]*Operand // the operand holding the value of each name
 }
 
 func (cg *CodeGen) Generate(n *node) *Block {
 	cg.Code = &Block{}
 	cg.Counter = 0
+	cg.Labels = 0
+	cg.Vars = map[string]*Operand{}
 	out := cg.gen(n)
 	cg.AddInstr(&Instr{
 		Op: OUT,
@@ -108,6 +226,11 @@ func (cg *CodeGen) gen(n *node) *Operand {
 			Data: n.val,
 			Type: tARGU,
 		}
+	case Tid:
+		return cg.Vars[n.val]
+	case Tkey: // let name = value; rest
+		cg.Vars[n.leafs[0].val] = cg.gen(n.leafs[1])
+		return cg.gen(n.leafs[2])
 	}
 	if len(n.leafs) == 1 { // unary
 		out := cg.gen(n.leafs[0])
@@ -116,6 +239,9 @@ func (cg *CodeGen) gen(n *node) *Operand {
 		}
 		return out
 	}
+	if n.val == "?" {
+		return cg.GenCond(n)
+	}
 	a := cg.gen(n.leafs[0])
 	b := cg.gen(n.leafs[1])
 	return cg.GenOp(n.val, a, b) // <OP> a, b -> Rx
@@ -129,6 +255,15 @@ func (cg *CodeGen) NextRegister() *Operand {
 	}
 }
 
+func (cg *CodeGen) NextLabel() *Operand {
+	l := cg.Labels
+	cg.Labels++
+	return &Operand{
+		Data: fmt.Sprint("L", l),
+		Type: tLABL,
+	}
+}
+
 func (cg *CodeGen) AddInstr(i *Instr) {
 	*cg.Code = append(*cg.Code, i)
 }
@@ -158,3 +293,28 @@ func (cg *CodeGen) GenInverse(a *Operand) *Operand {
 	})
 	return out
 }
+
+/*GenCond generates both branches in their own basic blocks,
+each one ends moving it's result to the same register
+
+	JZ cond, Lelse
+	... -> Ra
+	MOV Ra -> Rout
+	JMP Lend
+Lelse:
+	... -> Rb
+	MOV Rb -> Rout
+Lend:
+*/
+func (cg *CodeGen) GenCond(n *node) *Operand {
+	cond := cg.gen(n.leafs[0])
+	elseL, endL := cg.NextLabel(), cg.NextLabel()
+	out := cg.NextRegister()
+	cg.AddInstr(&Instr{Op: JZ, a: cond, b: elseL})
+	cg.AddInstr(&Instr{Op: MOV, a: cg.gen(n.leafs[1]), b: out})
+	cg.AddInstr(&Instr{Op: JMP, a: endL})
+	cg.AddInstr(&Instr{Op: LABEL, a: elseL})
+	cg.AddInstr(&Instr{Op: MOV, a: cg.gen(n.leafs[2]), b: out})
+	cg.AddInstr(&Instr{Op: LABEL, a: endL})
+	return out
+}
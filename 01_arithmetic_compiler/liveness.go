@@ -0,0 +1,127 @@
+package main
+
+import "sort"
+
+/*Liveness has the control flow graph of a Block and the virtual registers
+that are live at the start (In) and at the end (Out) of each basic block.
+A value is live if it can still be used before being written again.
+*/
+type Liveness struct {
+	Blocks []Block
+	Succs  [][]int // indices of the blocks that can run after each block
+	In     []map[string]bool
+	Out    []map[string]bool
+}
+
+func isVReg(op *Operand) bool {
+	return op != nil && op.Type == tREGI
+}
+
+/*Live computes the liveness of the virtual registers, with the usual
+backwards data flow equations, iterated until nothing changes:
+
+	Out[b] = union of In[s] for every successor s
+	In[b] = Uses[b] + (Out[b] - Defs[b])
+*/
+func Live(code Block) *Liveness {
+	lv := &Liveness{Blocks: code.BasicBlocks()}
+	n := len(lv.Blocks)
+	lv.Succs = make([][]int, n)
+	lv.In = make([]map[string]bool, n)
+	lv.Out = make([]map[string]bool, n)
+
+	labels := map[string]int{}
+	for i, bb := range lv.Blocks {
+		if bb[0].Op == LABEL {
+			labels[bb[0].a.Data] = i
+		}
+	}
+	uses := make([]map[string]bool, n)
+	defs := make([]map[string]bool, n)
+	for i, bb := range lv.Blocks {
+		last := bb[len(bb)-1]
+		switch {
+		case last.Op == JMP:
+			lv.Succs[i] = []int{labels[last.a.Data]}
+		case last.Op == JZ && i+1 < n:
+			lv.Succs[i] = []int{i + 1, labels[last.b.Data]}
+		case last.Op == JZ:
+			lv.Succs[i] = []int{labels[last.b.Data]}
+		case i+1 < n:
+			lv.Succs[i] = []int{i + 1}
+		}
+		uses[i], defs[i] = map[string]bool{}, map[string]bool{}
+		for _, ins := range bb {
+			for _, op := range ins.Uses() {
+				if isVReg(op) && !defs[i][op.String()] {
+					uses[i][op.String()] = true
+				}
+			}
+			if d := ins.Def(); isVReg(d) {
+				defs[i][d.String()] = true
+			}
+		}
+		lv.In[i], lv.Out[i] = map[string]bool{}, map[string]bool{}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := n - 1; i >= 0; i-- {
+			for _, s := range lv.Succs[i] {
+				for v := range lv.In[s] {
+					lv.Out[i][v] = true
+				}
+			}
+			in := map[string]bool{}
+			for v := range uses[i] {
+				in[v] = true
+			}
+			for v := range lv.Out[i] {
+				if !defs[i][v] {
+					in[v] = true
+				}
+			}
+			if len(in) != len(lv.In[i]) {
+				changed = true
+			}
+			lv.In[i] = in
+		}
+	}
+	return lv
+}
+
+/*Walk calls fn for each instruction from the last to the first of each block,
+with the values that are live right after the instruction
+*/
+func (lv *Liveness) Walk(fn func(ins *Instr, live map[string]bool)) {
+	for i, bb := range lv.Blocks {
+		live := map[string]bool{}
+		for v := range lv.Out[i] {
+			live[v] = true
+		}
+		for j := len(bb) - 1; j >= 0; j-- {
+			ins := bb[j]
+			fn(ins, live)
+			if d := ins.Def(); isVReg(d) {
+				delete(live, d.String())
+			}
+			for _, op := range ins.Uses() {
+				if isVReg(op) {
+					live[op.String()] = true
+				}
+			}
+		}
+	}
+}
+
+/*sorted returns the keys of a set in order, so the output doesn't
+depend on the order maps are iterated
+*/
+func sorted(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for v := range set {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 /*
 Physical registers are just a number between 0 and 13, if 14
@@ -31,8 +35,8 @@ func (r *Resources) Free(pReg int) {
 the current instruction, observe that we don't need the current position
 since the largest index would be the furthest away anyway*/
 func (r *Resources) FurthestUse() int {
-	dist := 0
-	reg := 0
+	dist := -1
+	reg := -1
 	for i := range r.Next {
 		if r.Next[i] > dist {
 			dist = r.Next[i]
@@ -42,107 +46,177 @@ func (r *Resources) FurthestUse() int {
 	return reg
 }
 
+/*Release frees the register with the old value of a virtual register that
+is written again, the instruction writing it doesn't read it (See ParseIR)
+*/
+func (r *Resources) Release(vReg string) {
+	if pReg, ok := r.Location[vReg]; ok {
+		r.Free(pReg)
+	}
+}
+
+/*Unpin marks the registers pinned by the last instruction as
+not needed soon, their next use is computed again if needed
+*/
+func (r *Resources) Unpin() {
+	for i := range r.Next {
+		if r.Next[i] == -1 {
+			r.Next[i] = 0
+		}
+	}
+}
+
+/*Allocator is the local allocator, it allocates the registers of each
+basic block on its own and generates x86-64 directly, with the registers
+of x64Reg and the instructions of OpToASM and OpToSet
+*/
 type Allocator struct {
 	in   *Block
 	curr int
 	out  string
 
-	Address   map[string]int // virtual register -> stack offset
-	rbpOffset int            // current offset from top of stack
+	Address   map[string]int  // virtual register -> stack offset
+	rbpOffset int             // current offset from top of stack
+	dirty     map[string]bool // virtual registers changed since they were stored
+
+	Stores, Loads int // memory accesses to spilled values
 }
 
+/*Begin allocates each basic block on it's own, the registers are empty
+at the start of every block, and the values still needed at the end of
+a block are stored in the stack (See Allocator.EndBlock)
+*/
 func (alc *Allocator) Begin(res *Resources) string {
-	alc.out = Header
-	for _, ins := range *alc.in {
-		alc.curr++
-		if ins.c != nil { // 3 operands, ADD, MUL, SUB, DIV
-			if ins.Op == DIV {
+	alc.out = ""
+	for _, bb := range alc.in.BasicBlocks() {
+		for _, ins := range bb {
+			alc.curr++
+			res.Unpin()
+			switch {
+			case ins.Op == LABEL:
+				alc.out += ins.a.Data + ":\n"
+			case ins.Op == JMP:
+				alc.EndBlock(res)
+				alc.out += "\tjmp\t" + ins.a.Data + "\n"
+			case ins.Op == JZ:
+				pReg := alc.Ensure(ins.a, res)
+				alc.EndBlock(res) // stores don't change the flags, but cmp must come after them
+				alc.out += fmt.Sprintf("\tcmp\t%s, 0\n", x64Reg[pReg])
+				alc.out += "\tje\t" + ins.b.Data + "\n"
+			case ins.Op == DIV:
 				alc.GenDiv(ins, res)
-				continue
+			case ins.c != nil: // 3 operands, ADD, MUL, SUB, shifts and comparisons
+				regC := alc.Define(ins.c, res)
+				regA := alc.GenCode(ins.a, "mov", regC, res)
+				var regB int
+				if set, ok := OpToSet[ins.Op]; ok {
+					regB = alc.GenCode(ins.b, "cmp", regC, res)
+					alc.out += fmt.Sprintf("\tmov\t%s, 0\n", x64Reg[regC]) // mov doesn't change the flags
+					alc.out += fmt.Sprintf("\t%s\t%s\n", set, x64Reg8[regC])
+				} else {
+					regB = alc.GenCode(ins.b, OpToASM[ins.Op], regC, res)
+				}
+				alc.FreeIfNotNeeded(ins.a, regA, res)
+				alc.FreeIfNotNeeded(ins.b, regB, res)
+			case ins.Op == MOV:
+				regB := alc.Define(ins.b, res)
+				regA := alc.GenCode(ins.a, "mov", regB, res)
+				alc.FreeIfNotNeeded(ins.a, regA, res)
+			default: // OUT
+				pReg := alc.Ensure(ins.a, res)
+				alc.out += fmt.Sprintf("\tpush\t%s\n", x64Reg[pReg])
 			}
-			regC := alc.Alloc(ins.c.Data, res)
-			regA := alc.GenCode(ins.a, "mov", regC, res)
-			regB := alc.GenCode(ins.b, OpToASM[ins.Op], regC, res)
-
-			alc.FreeIfNotNeeded(ins.a, regA, res)
-			alc.FreeIfNotNeeded(ins.b, regB, res)
-			continue
 		}
-		if ins.b != nil { // 2 operands, always MOV
-			pReg := alc.Alloc(ins.b.Data, res)
-			alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[pReg], ins.a.Data)
-			continue
+		if !bb[len(bb)-1].IsJump() {
+			alc.EndBlock(res)
 		}
-		pReg := alc.Ensure(ins.a, res)
-		alc.out += fmt.Sprintf("\tpush\t%s\n", x64Reg[pReg])
 	}
-	alc.out += Tail
-	return alc.out
+	frame := ""
+	if alc.rbpOffset > 0 {
+		frame = fmt.Sprintf("\tsub\trsp, %v\n", alc.rbpOffset)
+	}
+	return X64.Assemble(alc.in, frame, alc.out)
 }
 
 /* GenCode ensures the value is either in a register or is a literal
 then generates the code with pRegOut as the target register.
-It's implemented as a separate function to avoid repetition for each operand
+It's implemented as a separate function to avoid repetition for each operand.
+Literals that don't fit in 32 bits can only be used with mov, so they're put in a register
 */
 func (alc *Allocator) GenCode(op *Operand, ins string, pRegOut int, res *Resources) int {
-	switch op.Type {
-	case tNUMB:
+	if op.Type == tNUMB && (ins == "mov" || isImm32(op.Data)) {
 		alc.out += fmt.Sprintf("\t%s\t%s, %s\n", ins, x64Reg[pRegOut], op.Data)
-	case tARGU, tREGI:
-		pReg := alc.Ensure(op, res)
-		alc.out += fmt.Sprintf("\t%s\t%s, %s\n", ins, x64Reg[pRegOut], x64Reg[pReg])
-		return pReg
+		return pRegOut
 	}
-	return pRegOut
+	pReg := alc.Ensure(op, res)
+	alc.out += fmt.Sprintf("\t%s\t%s, %s\n", ins, x64Reg[pRegOut], x64Reg[pReg])
+	return pReg
 }
 
-/* FreeIfNotNeeded check's if the value is needed, and if not, frees the physical register
-Literals are never needed, so it just returns.
+func isImm32(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 32)
+	return err == nil
+}
+
+/* FreeIfNotNeeded check's if the value is needed, and if not, frees the physical register.
+Literals used as immediates are not in a register, and the register may have been
+taken by other value in the meantime, in both cases there's nothing to free.
 */
 func (alc *Allocator) FreeIfNotNeeded(op *Operand, pReg int, res *Resources) {
-	if op.Type == tNUMB {
+	vReg := op.String()
+	if res.Value[pReg] != vReg {
 		return
 	}
-	if !alc.IsNeeded(op.Data, pReg, res) {
+	if !alc.IsNeeded(vReg, pReg, res) {
 		res.Free(pReg)
 	}
 }
 
 /* Ensure ensures that the operand is in a register,
-if the operand is a literal, it returns a invalid register (-1)
-if a literal needs to be in a register for a particular operation
-other code must be used (See Allocator.GenDiv method)
+loading literals, arguments and values from the stack if needed.
 */
 func (alc *Allocator) Ensure(op *Operand, res *Resources) int {
-	if v, ok := res.Location[op.Data]; ok {
+	vReg := op.String()
+	if v, ok := res.Location[vReg]; ok {
 		return v
 	}
-	pReg := alc.Alloc(op.Data, res)
+	src := alc.Source(op, res)
+	pReg := alc.Alloc(vReg, res)
+	alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[pReg], src)
+	return pReg
+}
+
+/* Source returns where the operand can be read from without allocating a register,
+values that are not in registers must be literals, arguments or have been stored.
+*/
+func (alc *Allocator) Source(op *Operand, res *Resources) string {
+	vReg := op.String()
+	if pReg, ok := res.Location[vReg]; ok {
+		return x64Reg[pReg]
+	}
 	switch op.Type {
 	case tNUMB:
-		alc.out += fmt.Sprintf("\tmov\t%s, %v\n", x64Reg[pReg], op.Data)
-		return pReg
+		return op.Data
 	case tARGU:
-		offset := 16 + 8*LangArgToIndex(op.Data)
-		alc.out += fmt.Sprintf("\tmov\t%s, [rbp + %v]\n", x64Reg[pReg], offset)
-		return pReg
+		return fmt.Sprintf("qword [rbp + %v]", 16+8*LangArgToIndex(op.Data))
 	case tREGI:
-		if v, ok := alc.Address[op.Data]; ok {
-			alc.out += fmt.Sprintf("\tmov\t%s, [rbp - %v]\n", x64Reg[pReg], v)
-			return pReg
+		if v, ok := alc.Address[vReg]; ok {
+			alc.Loads++
+			return fmt.Sprintf("qword [rbp - %v]", v)
 		}
 		panic("We lost a needed value!")
 	}
-	panic("Allocator.Ensure: This Shouldn't execute!!!")
+	panic("Allocator.Source: This Shouldn't execute!!!")
 }
 
 /* IsNeeded performs a linear scan through the input instructions
 to see if the value is used again. If it finds one use, it updates
 Resources.Next with the index of the next use and returns true.
+There are no loops, so every use that can still happen comes later in the block.
 */
 func (alc *Allocator) IsNeeded(vReg string, pReg int, res *Resources) bool {
 	for i, ins := range (*alc.in)[alc.curr:] {
-		if ins.a.Data == vReg || (ins.b != nil && ins.b.Data == vReg) {
+		if uses(ins, vReg) {
 			res.Next[pReg] = alc.curr + i
 			return true
 		}
@@ -153,109 +227,165 @@ func (alc *Allocator) IsNeeded(vReg string, pReg int, res *Resources) bool {
 /* Alloc allocates a physical register to hold the value represented
 by the virtual register. If no physical register is available, it finds
 the physical register that's needed further from the current instruction index
-and pushes the value to the stack (See Allocator.GenStore).
+and stores the value in the stack (See Allocator.GenStore).
+Registers allocated for the current instruction, or holding it's operands,
+are pinned and never chosen.
 */
 func (alc *Allocator) Alloc(vReg string, res *Resources) int {
-	pReg := -1
 	if res.Available.IsEmpty() {
-		pReg = res.FurthestUse() // find biggest value in Next
-		val := res.Value[pReg]
-		alc.GenStore(val, pReg) // generate store for the value in the register
-		res.Free(pReg)          // push on top of stack
+		curr := (*alc.in)[alc.curr-1]
+		for pReg, val := range res.Value {
+			switch {
+			case res.Next[pReg] == -1:
+			case uses(curr, val):
+				res.Next[pReg] = -1
+			case !alc.IsNeeded(val, pReg, res):
+				res.Next[pReg] = 1 << 32 // not needed, so it's the best choice
+			}
+		}
+		pReg := res.FurthestUse() // find biggest value in Next
+		if pReg < 0 {
+			panic("Not enough registers for a single instruction")
+		}
+		if res.Next[pReg] != 1<<32 {
+			alc.Spill(res.Value[pReg], pReg) // generate store for the value in the register
+		}
+		res.Free(pReg) // push on top of stack
 	}
-	pReg = res.Available.Pop() // pop top of stack
+	pReg := res.Available.Pop() // pop top of stack
 	res.Location[vReg] = pReg
 	res.Value[pReg] = vReg
 	res.Next[pReg] = -1 // to guarantee it's not used by the current operation
 	return pReg
 }
 
-/* GenStore generates code to push the given value to the stack,
+/*Define allocates the register written by the instruction,
+the value in the stack, if any, is now outdated, and so is the
+register with the old value, if the virtual register is written again
+*/
+func (alc *Allocator) Define(op *Operand, res *Resources) int {
+	res.Release(op.String())
+	alc.dirty[op.String()] = true
+	return alc.Alloc(op.String(), res)
+}
+
+func uses(ins *Instr, vReg string) bool {
+	for _, op := range ins.Uses() {
+		if op.String() == vReg {
+			return true
+		}
+	}
+	return false
+}
+
+/*isTemp is true for virtual registers, literals and
+arguments don't need to be stored, they can be loaded again
+*/
+func isTemp(vReg string) bool {
+	return strings.HasPrefix(vReg, "R")
+}
+
+/* GenStore generates code to store the given value in the stack,
 it also saves the address as an offset from the base pointer for
-further references to this virtual register.
-The base pointer is set at the initialization as the very top of the
-stack (mov rbp, rsp), the address [rbp] then stores the number of
-console arguments given to the program.
+further references to this virtual register. Every virtual register
+has a single address, so all the paths that reach a label agree on where
+the values are. The base pointer is set at the initialization as the
+very top of the stack (mov rbp, rsp), the address [rbp] then stores the
+number of console arguments given to the program, and the space for the
+stored values is reserved right after it.
 */
 func (alc *Allocator) GenStore(vReg string, pReg int) {
-	alc.out += "\tpush\t" + x64Reg[pReg] + "\n"
-	alc.rbpOffset += 8
-	alc.Address[vReg] = alc.rbpOffset
+	offset, ok := alc.Address[vReg]
+	if !ok {
+		alc.rbpOffset += 8
+		offset = alc.rbpOffset
+		alc.Address[vReg] = offset
+	}
+	alc.out += fmt.Sprintf("\tmov\t[rbp - %v], %s\n", offset, x64Reg[pReg])
 }
 
-/*MoveOrStore moves the given value out of the physical register holding it,
-if there's an available register it just moves, otherwise it generates a store.*/
-func (alc *Allocator) MoveOrStore(vReg string, pReg int, res *Resources) {
-	if res.Available.IsEmpty() {
+/*Spill stores the virtual register only if it's not already in the stack,
+values used many times are loaded many times, but stored only once
+*/
+func (alc *Allocator) Spill(vReg string, pReg int) {
+	if isTemp(vReg) && alc.dirty[vReg] {
+		alc.Stores++
 		alc.GenStore(vReg, pReg)
-		return
+		alc.dirty[vReg] = false
+	}
+}
+
+/*EndBlock stores the values in registers that are needed by other blocks
+and frees every register. Jumps only see the stack, so it doesn't matter
+from which block the execution came from.
+*/
+func (alc *Allocator) EndBlock(res *Resources) {
+	for pReg := range res.Next {
+		vReg, ok := res.Value[pReg]
+		if !ok {
+			continue
+		}
+		if alc.IsNeeded(vReg, pReg, res) {
+			alc.Spill(vReg, pReg)
+		}
+		res.Free(pReg)
 	}
-	newpReg := alc.Alloc(vReg, res)
-	alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[newpReg], x64Reg[pReg])
 }
 
 /* GenDiv generates code for a division. Since the idiv instruction
 uses both RAX and RDX to store the quotient and remainder respectively,
-it needs special care.
-Also, RDX must be zeroed before the instruction, otherwise you'll get a
-Floating point exception. Note that we don't use the value on RDX, we're just cleaning it,
-so we don't need to allocate and therefore we don't need to free at the end.
+it needs special care. Both are emptied first, storing the values that
+are still needed, then cqo extends the sign of RAX into RDX,
+otherwise you'll get a Floating point exception or the wrong result with negative numbers.
+The divisor is read from the stack if it's not in a register,
+so the division doesn't need to allocate other registers, and it's
+compared with zero before the division (See DivCheck).
 */
 func (alc *Allocator) GenDiv(ins *Instr, res *Resources) {
-	const rax, rbx, rdx = 0, 1, 3
+	const rax, rdx = 0, 3
 
-	alc.EspecEnsure(ins.a, rax, res)                                    // ensure A is in rax, regardless of it's type
-	alc.EnsureFree(rdx, res)                                            // ensure rdx is free
-	alc.out += fmt.Sprintf("\txor\t%s, %s\n", x64Reg[rdx], x64Reg[rdx]) // make sure rdx is zeroed
+	srcA := alc.Source(ins.a, res)
+	alc.Evict(rax, ins.b, res)
+	alc.Evict(rdx, ins.b, res)
+	if srcA != x64Reg[rax] {
+		alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[rax], srcA)
+	}
 
-	alc.EspecEnsure(ins.b, rbx, res) // must not be in rax or rdx, here using rbx is suboptimal, but works
-	alc.out += fmt.Sprintf("\tidiv\t%s\n", x64Reg[rbx])
+	srcB := alc.Source(ins.b, res)
+	if srcB == ins.b.Data { // idiv doesn't take immediates
+		alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[rdx], ins.b.Data)
+		alc.GenStore(ins.b.String(), rdx)
+		srcB = fmt.Sprintf("qword [rbp - %v]", alc.Address[ins.b.String()])
+	}
+	if needsCheck(ins.b) {
+		alc.out += fmt.Sprintf(DivCheck, srcB)
+	}
+	alc.out += "\tcqo\n"
+	alc.out += "\tidiv\t" + srcB + "\n"
 
-	alc.FreeIfNotNeeded(ins.b, rbx, res)
-	res.Location[ins.c.Data] = rax
-	res.Value[rax] = ins.c.Data
+	if pReg, ok := res.Location[ins.b.String()]; ok {
+		alc.FreeIfNotNeeded(ins.b, pReg, res)
+	}
+	res.Release(ins.c.String())
+	res.Available.Remove(rax)
+	alc.dirty[ins.c.String()] = true
+	res.Location[ins.c.String()] = rax
+	res.Value[rax] = ins.c.String()
+	res.Next[rax] = -1
 }
 
-/* EspecEnsure ensures that the value is stored in a specific register
-this is used in the idiv instruction, since it always explicitly
-uses the RAX and RDX registers as the result
+/* Evict empties the physical register, storing the value in it if it's needed
+later or if it's the divisor, which can't stay in RAX or RDX.
 */
-func (alc *Allocator) EspecEnsure(op *Operand, pReg int, res *Resources) {
-	vRegOld := alc.EnsureFree(pReg, res)
-	if vRegOld == op.Data {
+func (alc *Allocator) Evict(pReg int, divisor *Operand, res *Resources) {
+	vReg, ok := res.Value[pReg]
+	if !ok {
 		return
 	}
-	switch op.Type {
-	case tNUMB:
-		alc.out += fmt.Sprintf("\tmov\t%s, %v\t\n", x64Reg[pReg], op.Data)
-		return
-	case tARGU:
-		offset := 16 + 8*LangArgToIndex(op.Data)
-		alc.out += fmt.Sprintf("\tmov\t%s, [rbp + %v]\n", x64Reg[pReg], offset)
-		return
-	case tREGI:
-		if pRegOld, ok := res.Location[op.Data]; ok { // if it is in a physical register
-			alc.out += fmt.Sprintf("\tmov\t%s, %s\n", x64Reg[pReg], x64Reg[pRegOld])
-			return
-		}
-		if offset, ok := alc.Address[op.Data]; ok { // if it is in the stack
-			alc.out += fmt.Sprintf("\tmov\t%s, [rbp - %v]\n", x64Reg[pReg], offset)
-			return
-		}
+	if vReg == divisor.String() || alc.IsNeeded(vReg, pReg, res) {
+		alc.Spill(vReg, pReg)
 	}
-	fmt.Printf("This shouldn't execute %#v\n", op)
-	panic("Oops")
-}
-
-/* EnsureFree ensures that the physical register is free,
-if there's a needed value in it, it moves the value somewhere else.
-*/
-func (alc *Allocator) EnsureFree(pReg int, res *Resources) string {
-	vRegOld, ok := res.Value[pReg]
-	if ok && alc.IsNeeded(vRegOld, pReg, res) { // if the register is occupied and the value is needed
-		alc.MoveOrStore(vRegOld, pReg, res)
-	}
-	return vRegOld
+	res.Free(pReg)
 }
 
 type Stack struct {
@@ -298,3 +428,17 @@ func (s *Stack) IsFull() bool {
 	}
 	return false
 }
+
+/*Remove takes the register out of the stack if it's there,
+so it can be used for a specific purpose
+*/
+func (s *Stack) Remove(r int) bool {
+	for i := 0; i <= s.Top; i++ {
+		if s.Data[i] == r {
+			copy(s.Data[i:], s.Data[i+1:s.Top+1])
+			s.Top--
+			return true
+		}
+	}
+	return false
+}
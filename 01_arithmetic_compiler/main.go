@@ -1,54 +1,114 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var lang_args = []string{}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: calc \"Expr\"")
-
-		fmt.Println(`
-Expr := Term {('+' | '-') Term}.
+const grammar = `
+Program ::= {'let' ident '=' Expr ';'} Expr
+Expr ::= Cond
+Cond ::= Cmp ['?' Expr ':' Cond]
+Cmp ::= Sum [('==' | '!=' | '<' | '<=' | '>' | '>=') Sum]
+Sum ::= Term {('+' | '-') Term}
 Term ::= Unary {('*' | '/') Unary}
 Unary ::= [('+' | '-')] Factor
-Factor := '(' Expr ')'
-	| number.
+Factor ::= '(' Expr ')'
+	| '$' index
+	| ident
+	| number
+
+number ::= [0-9][0-9]*
+index ::= [1-9][0-9]*
+ident ::= [a-zA-Z_][a-zA-Z0-9_]*
 
-number ::= [0-9]+\.?[0-9]*`)
+Comparisons result in 1 or 0, and the condition of '?' is true if it's not 0.
+Use -- before expressions that start with '-'`
+
+func main() {
+	arch := flag.String("target", "x86-64", "machine to generate code for, x86-64 (NASM) or aarch64 (GNU as)")
+	alloc := flag.String("alloc", "local", "register allocator, local or global, aarch64 only has global")
+	regs := flag.Int("regs", 3, "number of registers available to the allocator, from 3 to 14 in x86-64 and 25 in aarch64")
+	spills := flag.Bool("spills", false, "print the stores and loads of spilled values for both allocators")
+	exe := flag.String("o", "", "also write a static ELF64 executable to the file, without NASM, only for x86-64")
+	wat := flag.String("wat", "", "also write a WebAssembly text module exporting main to the file, without allocating registers")
+	passes := flag.String("O", "", "optimization passes to run in order, separated by commas: fold, cse, strength, dce or all")
+	dumpIR := flag.Bool("dump-ir", false, "print the code after each optimization pass")
+	irFile := flag.String("ir", "", "read the 3 address code from the file instead of an expression, only the arguments follow the flags")
+	flag.Usage = func() {
+		fmt.Println("Usage: calc [flags] \"Expr\" args...")
+		fmt.Println("       calc [flags] -ir file args...")
+		flag.PrintDefaults()
+		fmt.Println(grammar)
+	}
+	flag.Parse()
+	if flag.NArg() < 1 && *irFile == "" {
+		flag.Usage()
 		os.Exit(0)
 	}
-	str := os.Args[1]
-	lang_args = os.Args[2:]
-	tks := LexStr(str)
-	fmt.Printf("%s\n", tks)
-	root := Parse(tks)
-	fmt.Println(root)
-	fmt.Println(solve(root))
-	gen := &CodeGen{}
-	b := gen.Generate(root)
+	t, ok := Targets[*arch]
+	if !ok {
+		log.Fatalf("Invalid target: %v, expected x86-64 or aarch64", *arch)
+	}
+	if *regs < 3 || *regs > len(t.Regs) {
+		log.Fatalf("Invalid number of registers: %v, expected a number from 3 to %v", *regs, len(t.Regs))
+	}
+	if t == A64 && !isFlagSet("alloc") {
+		*alloc = "global"
+	}
+	if !contains(t.Allocators, *alloc) {
+		log.Fatalf("Invalid allocator for %v: %v, expected %v", t.Name, *alloc, strings.Join(t.Allocators, " or "))
+	}
+	if *exe != "" && t != X64 {
+		log.Fatalf("-o only writes x86-64 executables")
+	}
+	var b *Block
+	if *irFile != "" {
+		lang_args = flag.Args()
+		b = loadIR(*irFile)
+	} else {
+		lang_args = flag.Args()[1:]
+		b = compile(flag.Arg(0))
+	}
 	fmt.Println(b)
+	if *passes != "" {
+		var dump func(string, Block)
+		if *dumpIR {
+			dump = func(name string, code Block) {
+				fmt.Printf("after %v: %v\n", name, code)
+			}
+		}
+		code, err := Optimize(*b, *passes, dump)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b = &code
+	}
 	m := Machine{}
-	m.Run(b)
-	alc := &Allocator{
-		in:        b,
-		Address:   make(map[string]int, 8),
-		rbpOffset: 0,
-	}
-	res := &Resources{
-		Available: NewStack(3),
-		Next:      make([]int, 3),
-		Location:  make(map[string]int, 8),
-		Value:     make(map[int]string, 8),
-	}
-	out := alc.Begin(res)
+	err := m.Run(b)
+	for _, out := range m.Out {
+		fmt.Println(out)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	if *spills {
+		for _, name := range t.Allocators {
+			_, stores, loads := t.Generate(b, name, *regs)
+			fmt.Printf("%v: %v stores, %v loads\n", name, stores, loads)
+		}
+	}
+	out, _, _ := t.Generate(b, *alloc, *regs)
 	fmt.Println(out)
-	f, err := os.OpenFile("out.s", os.O_RDWR|os.O_CREATE, 0777)
+	f, err := os.OpenFile("out.s", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
 	if err != nil {
 		panic(err)
 	}
@@ -57,23 +117,150 @@ number ::= [0-9]+\.?[0-9]*`)
 	if err != nil {
 		panic(err)
 	}
+	if *exe != "" {
+		writeELF(*exe, out)
+	}
+	if *wat != "" {
+		if err := ioutil.WriteFile(*wat, []byte(WAT(*b)), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
-func solve(n *node) int {
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*compile runs the front end, printing the tokens,
+the tree and the result of solve, and generates the code
+*/
+func compile(src string) *Block {
+	tks := LexStr(src)
+	fmt.Printf("%s\n", tks)
+	root := Parse(tks)
+	fmt.Println(root)
+	if n := MaxArg(tks); len(lang_args) < n {
+		fmt.Printf("Usage: calc \"Expr\" args..., the expression uses %v arguments, but %v were given\n", n, len(lang_args))
+		os.Exit(1)
+	}
+	if res, err := Solve(root); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(res)
+	}
+	gen := &CodeGen{}
+	return gen.Generate(root)
+}
+
+/*loadIR reads the code from a file (See ParseIR)
+ */
+func loadIR(name string) *Block {
+	src, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ParseIR(string(src))
+	if err != nil {
+		log.Fatalf("%v: %v", name, err)
+	}
+	if n := b.MaxArg(); len(lang_args) < n {
+		fmt.Printf("Usage: calc -ir file args..., the code uses %v arguments, but %v were given\n", n, len(lang_args))
+		os.Exit(1)
+	}
+	return &b
+}
+
+/*writeELF encodes the assembly and writes the executable,
+the allocators only generate what the encoder knows, so errors are bugs
+*/
+func writeELF(name, asm string) {
+	e, err := Encode(asm)
+	if err != nil {
+		panic(err)
+	}
+	bin, err := ELF(e)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(name, bin, 0755)
+	if err != nil {
+		panic(err)
+	}
+}
+
+/*ErrDivByZero is the panic of solve and Machine.Run when the divisor is zero,
+the generated program prints the same message and exits with status 1
+*/
+var ErrDivByZero = errors.New("Division by zero")
+
+func divide(a, b int) int {
+	if b == 0 {
+		panic(ErrDivByZero)
+	}
+	return a / b
+}
+
+/*catchDivByZero recovers from a division by zero and sets err,
+other panics are bugs, so they continue
+*/
+func catchDivByZero(err *error) {
+	if r := recover(); r != nil {
+		if r != ErrDivByZero {
+			panic(r)
+		}
+		*err = ErrDivByZero
+	}
+}
+
+/*Solve evaluates the program, the error is ErrDivByZero
+ */
+func Solve(root *node) (out int, err error) {
+	defer catchDivByZero(&err)
+	return solve(root, map[string]int{}), nil
+}
+
+/*solve evaluates the tree, vars has the values of the names bound by let,
+since the rest of the program is inside the let node there's nothing to restore
+*/
+func solve(n *node, vars map[string]int) int {
 	switch n.tp {
 	case Tnum:
 		return StrToFloat(n.val)
 	case Targ:
 		index := LangArgToIndex(n.val)
 		return StrToFloat(lang_args[index])
+	case Tid:
+		return vars[n.val]
+	case Tkey:
+		vars[n.leafs[0].val] = solve(n.leafs[1], vars)
+		return solve(n.leafs[2], vars)
 	}
 	if len(n.leafs) == 1 { // unary
 		if n.val == "-" {
-			return -solve(n.leafs[0])
+			return -solve(n.leafs[0], vars)
+		}
+		return solve(n.leafs[0], vars)
+	}
+	if n.val == "?" {
+		if solve(n.leafs[0], vars) != 0 {
+			return solve(n.leafs[1], vars)
 		}
-		return solve(n.leafs[0])
+		return solve(n.leafs[2], vars)
 	}
-	return DoOp(n.val, solve(n.leafs[0]), solve(n.leafs[1]))
+	return DoOp(n.val, solve(n.leafs[0], vars), solve(n.leafs[1], vars))
 }
 
 func StrToFloat(s string) int {
@@ -94,13 +281,36 @@ func DoOp(op string, a, b int) int {
 	case "*":
 		return a * b
 	case "/":
-		return a / b
+		return divide(a, b)
+	case "==", "!=", "<", "<=", ">", ">=":
+		return Compare(SymbToOp[op], a, b)
 	default:
 		log.Fatalf("Invalid operation: %v", op)
 		return 0
 	}
 }
 
+/*MaxArg returns the highest argument in the source, names bound to
+an argument and never used don't generate code, so it can be
+higher than the number of arguments used by the generated code (See Block.MaxArg)
+*/
+func MaxArg(tks []*lexeme) int {
+	max := 0
+	for _, tk := range tks {
+		if tk.tp == Targ && LangArgToIndex(tk.val)+1 > max {
+			max = LangArgToIndex(tk.val) + 1
+		}
+	}
+	return max
+}
+
+/*LangArgToIndex converts "$1" to 0, the lexer only accepts
+arguments starting at 1, so the index is never negative
+*/
 func LangArgToIndex(arg string) int {
-	return int((arg[1] - 48) - 1)
+	i, err := strconv.Atoi(arg[1:])
+	if err != nil {
+		log.Fatalf("Invalid argument: %v", arg)
+	}
+	return i - 1
 }
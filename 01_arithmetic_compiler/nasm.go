@@ -1,7 +1,83 @@
 package main
 
-/*Tells the linker where the program starts
-and sets the base pointer to the stack pointer*/
+import "fmt"
+
+/*X64 generates NASM for x86-64 Linux, with either allocator. Division
+takes the dividend in RAX and RDX, and the comparisons set a byte register
+*/
+var X64 = &Target{
+	Name:       "x86-64",
+	Regs:       x64Reg,
+	Low:        x64Reg8,
+	Div:        []int{0, 3}, // RAX and RDX
+	Mem:        true,
+	TwoAddress: true,
+	Ops:        x64Ops(),
+
+	Move:     "\tmov\t%s, %s\n",
+	Load:     "\tmov\t%s, %s\n",
+	LoadLit:  "\tmov\t%s, %s\n",
+	Store:    "\tmov\t%[2]s, %[1]s\n",
+	Jmp:      "\tjmp\t%s\n",
+	Jz:       "\tcmp\t%s, 0\n\tje\t%s\n",
+	Out:      "\tpush\t%s\n",
+	DivCheck: DivCheck,
+
+	Arg: func(idx int) string {
+		return fmt.Sprintf("qword [rbp + %v]", 16+8*idx)
+	},
+	Slot: func(n int) string {
+		return fmt.Sprintf("qword [rbp - %v]", 8*(n+1))
+	},
+	Frame: func(slots int) string {
+		return fmt.Sprintf("\tsub\trsp, %v\n", 8*slots)
+	},
+
+	Allocators: []string{"local", "global"},
+
+	Header:   Header,
+	Tail:     Tail,
+	ArgCheck: ArgCheck,
+	Usage:    Usage,
+	DivZero:  DivZero,
+}
+
+/*x64Ops has the templates of the instructions, the operations of OpToASM
+and the comparisons of OpToSet, the first operand is already in the destination
+*/
+func x64Ops() map[Operator]string {
+	ops := map[Operator]string{DIV: "\tcqo\n\tidiv\t%[3]s\n"}
+	for op, name := range OpToASM {
+		if op != DIV {
+			ops[op] = "\t" + name + "\t%[1]s, %[3]s\n"
+		}
+	}
+	for op, set := range OpToSet {
+		ops[op] = "\tcmp\t%[1]s, %[3]s\n\tmov\t%[1]s, 0\n\t" + set + "\t%[4]s\n"
+	}
+	return ops
+}
+
+/*genLocal runs the local Allocator over the block,
+using the first regs registers
+*/
+func genLocal(b *Block, regs int) (string, int, int) {
+	alc := &Allocator{
+		in:        b,
+		Address:   make(map[string]int, 8),
+		rbpOffset: 0,
+		dirty:     make(map[string]bool, 8),
+	}
+	res := &Resources{
+		Available: NewStack(regs),
+		Next:      make([]int, regs),
+		Location:  make(map[string]int, 8),
+		Value:     make(map[int]string, 8),
+	}
+	out := alc.Begin(res)
+	return out, alc.Stores, alc.Loads
+}
+
 const Header = `
 	section .bss
 buff:	resb 	24		; 24 byte buffer
@@ -27,8 +103,8 @@ convert_loop:
 	mov	rbp, rsp
 `
 
-/*Makes an exit syscall with whatever value is in the
-rdi register, we can use this to return values smaller than 255*/
+/*Prints the result, which is on top of the stack,
+and makes an exit syscall with status 0*/
 const Tail = `
 exit:
 	call 	itoa		; converts the result to string
@@ -39,6 +115,7 @@ exit:
 	syscall
 
 	mov 	rax, 60
+	xor 	rdi, rdi	; status 0
 	syscall
 
 ; atoi takes one argument:
@@ -96,24 +173,23 @@ itoa:
 	mov 	r8, buff	; moves address of buffer to r8
 
 	cmp 	rax, 0 		; compares integer with zero
-	jg	plus		; if greater than zero then go to plus
+	jge	plus		; if not negative then go to plus
 	mov 	cl, '-'		; otherwise set cl to minus sign
 	imul 	rax, -1		; method only works with positive integers
 	jmp 	itoa_loop	; and jump to loop
 plus:
 	mov 	cl, '+'		; set cl to plus sign
 itoa_loop:
-	inc 	r8
 	xor 	rdx, rdx
 	mov 	rbx, 10
 	div	rbx
 	
 	add 	rdx, 48
 	mov 	[r8], dl
+	inc 	r8
 	cmp 	rax, 0
 	jne 	itoa_loop
 	
-	inc 	r8
 	mov 	[r8], cl	  	; puts sign at the end
 	mov 	[r8+1], byte(10)	; moves	end of string to the end
 
@@ -126,10 +202,10 @@ itoa_loop:
 				; r8 contains the last char
 
 reverse:			; reverses string in place
-	mov 	al, [r8]	; gets char at one end
+	mov 	dl, [r8]	; gets char at one end, rax has the size
 	mov 	cl, [rbx]	; gets char of other end
 	mov 	[r8], cl	; swap one char
-	mov 	[rbx], al	; with the other
+	mov 	[rbx], dl	; with the other
 	dec 	r8		; decrements the end
 	inc 	rbx		; increments the beginning
 	cmp 	r8, rbx		; they should meet at the middle
@@ -141,11 +217,82 @@ ret_itoa:
 	ret
 `
 
+/*ArgCheck is added after the Header when the program uses arguments,
+[rbp] has argc, which also counts the name of the program
+*/
+const ArgCheck = `	cmp 	qword [rbp], %v	; argc
+	jl 	usage		; not enough arguments
+`
+
+/*Usage is added after the Tail when the program uses arguments,
+it prints the number of arguments expected to stderr and exits with status 1
+*/
+const Usage = `
+	section .text
+usage:
+	mov 	rax, 1		; write syscall
+	mov 	rdi, 2		; file == stderr
+	mov 	rsi, usage_msg
+	mov 	rdx, usage_len
+	syscall
+
+	mov 	rax, 60
+	mov 	rdi, 1		; status 1
+	syscall
+
+	section .data
+usage_msg:	db 	"Usage: expected %v arguments", 10
+usage_len:	equ 	$ - usage_msg
+`
+
+/*DivCheck is added before each division, unless the divisor is
+a literal other than zero
+*/
+const DivCheck = `	cmp	%s, 0
+	je	div_zero
+`
+
+/*DivZero is added after the Tail when the program divides, it prints
+the same error as solve and Machine.Run and exits with status 1
+*/
+const DivZero = `
+	section .text
+div_zero:
+	mov 	rax, 1		; write syscall
+	mov 	rdi, 2		; file == stderr
+	mov 	rsi, div_msg
+	mov 	rdx, div_len
+	syscall
+
+	mov 	rax, 60
+	mov 	rdi, 1		; status 1
+	syscall
+
+	section .data
+div_msg:	db 	"Division by zero", 10
+div_len:	equ 	$ - div_msg
+`
+
 var OpToASM = map[Operator]string{
 	SUB: "sub",
 	ADD: "add",
 	MUL: "imul",
 	DIV: "idiv",
+	SHL: "shl",
+	SAR: "sar",
+	SHR: "shr",
+}
+
+/*OpToSet has the instructions that set a byte to 1 if the last comparison
+was true, their operand is the lowest byte of a register (See x64Reg8)
+*/
+var OpToSet = map[Operator]string{
+	EQ: "sete",
+	NE: "setne",
+	LT: "setl",
+	LE: "setle",
+	GT: "setg",
+	GE: "setge",
 }
 
 /*Note that we skip the special purpose registers,
@@ -155,3 +302,8 @@ var x64Reg = []string{
 	"rax", "rbx", "rcx", "rdx", "rsi", "rdi",
 	"r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15",
 }
+
+var x64Reg8 = []string{
+	"al", "bl", "cl", "dl", "sil", "dil",
+	"r8b", "r9b", "r10b", "r11b", "r12b", "r13b", "r14b", "r15b",
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*Pass transforms the code without changing what it prints, the
+instructions given are not modified, the changed ones are copied
+*/
+type Pass struct {
+	Name string
+	Run  func(code Block) Block
+}
+
+var Passes = []Pass{
+	{"fold", Fold},
+	{"cse", CSE},
+	{"strength", Strength},
+	{"dce", DCE},
+}
+
+/*Optimize runs the passes in the order given, separated by commas,
+"all" runs every pass once. dump is called with the code after each pass
+*/
+func Optimize(code Block, names string, dump func(name string, code Block)) (Block, error) {
+	run := []Pass{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := name == "all"
+		for _, pass := range Passes {
+			if pass.Name == name || name == "all" {
+				run = append(run, pass)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown pass %q, expected fold, cse, strength, dce or all", name)
+		}
+	}
+	for _, pass := range run {
+		code = pass.Run(code)
+		if dump != nil {
+			dump(pass.Name, code)
+		}
+	}
+	return code, nil
+}
+
+/*Every virtual register is written once, except the results of
+conditionals, which are written by a MOV at the end of each branch.
+Since the code comes from a tree, a register written once is always
+written before it's read, so it can be replaced by it's value everywhere
+*/
+func defCount(code Block) map[string]int {
+	out := map[string]int{}
+	for _, ins := range code {
+		if d := ins.Def(); isVReg(d) {
+			out[d.String()]++
+		}
+	}
+	return out
+}
+
+/*rewrite copies the instruction replacing the operands it reads*/
+func rewrite(ins *Instr, fn func(op *Operand) *Operand) *Instr {
+	out := *ins
+	switch {
+	case ins.Op == LABEL || ins.Op == JMP:
+	case ins.c != nil:
+		out.a, out.b = fn(ins.a), fn(ins.b)
+	default: // MOV, OUT and JZ
+		out.a = fn(ins.a)
+	}
+	return &out
+}
+
+func literal(n int) *Operand {
+	return &Operand{Data: strconv.Itoa(n), Type: tNUMB}
+}
+
+func isLiteral(op *Operand, n int) bool {
+	return op.Type == tNUMB && op.Data == strconv.Itoa(n)
+}
+
+/*Fold computes the instructions with literal operands at compile time,
+and replaces the registers they write by the result. It also removes
+the operations that don't change the value (x + 0, x * 1 ...) and decides
+the jumps with literal conditions. Division by zero is left to the runtime
+*/
+func Fold(code Block) Block {
+	defs := defCount(code)
+	known := map[string]*Operand{} // register -> literal or operand with the same value
+	get := func(op *Operand) *Operand {
+		if k, ok := known[op.String()]; ok && isVReg(op) {
+			return k
+		}
+		return op
+	}
+	out := Block{}
+	for _, ins := range code {
+		ins = rewrite(ins, get)
+		if ins.Op == JZ && ins.a.Type == tNUMB {
+			if isLiteral(ins.a, 0) {
+				out = append(out, &Instr{Op: JMP, a: ins.b})
+			}
+			continue
+		}
+		if d := ins.Def(); isVReg(d) && defs[d.String()] == 1 {
+			if v := simplify(ins); v != nil {
+				known[d.String()] = v
+				continue
+			}
+		}
+		out = append(out, ins)
+	}
+	return out
+}
+
+/*simplify returns the operand with the value of the result,
+or nil if it needs to be computed at runtime
+*/
+func simplify(ins *Instr) *Operand {
+	if ins.Op == MOV {
+		return ins.a
+	}
+	a, b := ins.a, ins.b
+	if a.Type == tNUMB && b.Type == tNUMB && !(ins.Op == DIV && isLiteral(b, 0)) {
+		return literal(Eval(ins.Op, StrToFloat(a.Data), StrToFloat(b.Data)))
+	}
+	switch ins.Op {
+	case ADD:
+		if isLiteral(a, 0) {
+			return b
+		}
+		fallthrough
+	case SUB, SHL, SAR, SHR:
+		if isLiteral(b, 0) {
+			return a
+		}
+	case MUL:
+		switch {
+		case isLiteral(a, 1):
+			return b
+		case isLiteral(b, 1):
+			return a
+		case isLiteral(a, 0) || isLiteral(b, 0):
+			return literal(0)
+		}
+	case DIV:
+		if isLiteral(b, 1) {
+			return a
+		}
+	}
+	return nil
+}
+
+var commutative = map[Operator]bool{ADD: true, MUL: true, EQ: true, NE: true}
+
+/*CSE removes the instructions that compute a value already computed
+in the same basic block (local value numbering), the register written by
+the copy is replaced by the first one. Values are not reused across
+blocks, a value computed in one branch doesn't exist in the other
+*/
+func CSE(code Block) Block {
+	defs := defCount(code)
+	same := map[string]*Operand{} // removed register -> register with the value
+	get := func(op *Operand) *Operand {
+		if r, ok := same[op.String()]; ok && isVReg(op) {
+			return r
+		}
+		return op
+	}
+	out := Block{}
+	for _, bb := range code.BasicBlocks() {
+		values := map[string]*Operand{} // expression -> register with it's value
+		for _, ins := range bb {
+			ins = rewrite(ins, get)
+			d := ins.Def()
+			if d == nil {
+				out = append(out, ins)
+				continue
+			}
+			for key, r := range values { // the values that depend on d are now outdated
+				if r.String() == d.String() || strings.Contains(key, " "+d.String()+",") {
+					delete(values, key)
+				}
+			}
+			if ins.c == nil || defs[d.String()] != 1 {
+				out = append(out, ins)
+				continue
+			}
+			a, b := ins.a.String(), ins.b.String()
+			if commutative[ins.Op] && a > b {
+				a, b = b, a
+			}
+			key := fmt.Sprintf("%v %v, %v,", OpToStr[ins.Op], a, b)
+			if r, ok := values[key]; ok {
+				same[d.String()] = r
+				continue
+			}
+			values[key] = d
+			out = append(out, ins)
+		}
+	}
+	return out
+}
+
+/*log2 returns k if n is 2^k with k > 0, or -1*/
+func log2(op *Operand) int {
+	if op.Type != tNUMB {
+		return -1
+	}
+	n := StrToFloat(op.Data)
+	for k := 1; k < 63; k++ {
+		if n == 1<<uint(k) {
+			return k
+		}
+	}
+	return -1
+}
+
+/*Strength replaces multiplications and divisions by powers of two with
+shifts, and multiplications by -1, how the unary minus is generated, with
+a subtraction from 0. A shift rounds down, but the division rounds towards zero, so the
+division adds 2^k - 1 to negative numbers first, computed from the sign:
+
+	SAR x, 63 -> t1     ; -1 if x is negative, 0 otherwise
+	SHR t1, 64-k -> t2  ; 2^k - 1 or 0
+	ADD x, t2 -> t3
+	SAR t3, k -> out
+*/
+func Strength(code Block) Block {
+	next := 0
+	for d := range defCount(code) {
+		if n, _ := strconv.Atoi(d[1:]); n >= next {
+			next = n + 1
+		}
+	}
+	reg := func() *Operand {
+		next++
+		return &Operand{Data: strconv.Itoa(next - 1)}
+	}
+	out := Block{}
+	for _, ins := range code {
+		switch {
+		case ins.Op == MUL && isLiteral(ins.b, -1):
+			out = append(out, &Instr{Op: SUB, a: literal(0), b: ins.a, c: ins.c})
+		case ins.Op == MUL && isLiteral(ins.a, -1):
+			out = append(out, &Instr{Op: SUB, a: literal(0), b: ins.b, c: ins.c})
+		case ins.Op == MUL && log2(ins.b) > 0:
+			out = append(out, &Instr{Op: SHL, a: ins.a, b: literal(log2(ins.b)), c: ins.c})
+		case ins.Op == MUL && log2(ins.a) > 0:
+			out = append(out, &Instr{Op: SHL, a: ins.b, b: literal(log2(ins.a)), c: ins.c})
+		case ins.Op == DIV && log2(ins.b) > 0:
+			k := log2(ins.b)
+			t1, t2, t3 := reg(), reg(), reg()
+			out = append(out,
+				&Instr{Op: SAR, a: ins.a, b: literal(63), c: t1},
+				&Instr{Op: SHR, a: t1, b: literal(64 - k), c: t2},
+				&Instr{Op: ADD, a: ins.a, b: t2, c: t3},
+				&Instr{Op: SAR, a: t3, b: literal(k), c: ins.c},
+			)
+		default:
+			out = append(out, ins)
+		}
+	}
+	return out
+}
+
+/*DCE removes the basic blocks that can't be reached, the jumps to the
+next instruction, the labels nobody jumps to and the instructions whose
+result is never used. Divisions are kept unless the divisor is a literal
+other than zero, the program must still fail when it divides by zero
+*/
+func DCE(code Block) Block {
+	lv := Live(code)
+	reached := make([]bool, len(lv.Blocks))
+	stack := []int{0}
+	for len(stack) > 0 && len(lv.Blocks) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reached[i] {
+			continue
+		}
+		reached[i] = true
+		stack = append(stack, lv.Succs[i]...)
+	}
+	flat := Block{}
+	for i, bb := range lv.Blocks {
+		if reached[i] {
+			flat = append(flat, bb...)
+		}
+	}
+
+	targets := map[string]bool{}
+	jumps := Block{}
+	for i, ins := range flat {
+		if ins.Op == JMP && i+1 < len(flat) && flat[i+1].Op == LABEL && flat[i+1].a.Data == ins.a.Data {
+			continue
+		}
+		if ins.Op == JMP {
+			targets[ins.a.Data] = true
+		}
+		if ins.Op == JZ {
+			targets[ins.b.Data] = true
+		}
+		jumps = append(jumps, ins)
+	}
+	code = Block{}
+	for _, ins := range jumps {
+		if ins.Op != LABEL || targets[ins.a.Data] {
+			code = append(code, ins)
+		}
+	}
+
+	for removed := true; removed; {
+		removed = false
+		dead := map[*Instr]bool{}
+		Live(code).Walk(func(ins *Instr, live map[string]bool) {
+			d := ins.Def()
+			pure := ins.Op != DIV || ins.b.Type == tNUMB && !isLiteral(ins.b, 0)
+			if isVReg(d) && !live[d.String()] && pure {
+				dead[ins] = true
+			}
+		})
+		out := Block{}
+		for _, ins := range code {
+			if dead[ins] {
+				removed = true
+				continue
+			}
+			out = append(out, ins)
+		}
+		code = out
+	}
+	return code
+}
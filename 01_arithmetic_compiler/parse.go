@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 )
 
@@ -45,14 +46,20 @@ func Parse(tks []*lexeme) *node {
 	p := &Parser{
 		tks:  tks,
 		word: tks[0],
+		vars: map[string]bool{},
 	}
-	return p.Expr()
+	root := p.Program()
+	if p.word.tp != Teof {
+		p.Fail()
+	}
+	return root
 }
 
 type Parser struct {
 	i    int
 	tks  []*lexeme
 	word *lexeme
+	vars map[string]bool // names bound so far
 }
 
 func (p *Parser) next() {
@@ -75,9 +82,80 @@ func (p *Parser) Fail() *node {
 	return nil
 }
 
+func (p *Parser) expect(val string) {
+	if p.word.val != val || p.word.tp != Tope {
+		p.Fail()
+	}
+	p.next()
+}
+
+/*Program is a sequence of let bindings followed by the result, each binding
+is a "let" node with the name, the value and the rest of the program as leafs,
+so the names are only visible after their binding
+*/
+func (p *Parser) Program() *node {
+	if p.word.tp != Tkey {
+		return p.Expr()
+	}
+	parent := newNode(p.word) // "let" node
+	p.next()
+	if p.word.tp != Tid {
+		p.Fail()
+	}
+	parent.AddLeaf(newNode(p.word))
+	p.next()
+	p.expect("=")
+	parent.AddLeaf(p.Expr())
+	p.expect(";")
+	p.vars[parent.leafs[0].val] = true
+	parent.AddLeaf(p.Program())
+	return parent
+}
+
 /*Whenever we sucessfully match a terminal p.Next will be present in the same block
  */
 func (p *Parser) Expr() *node {
+	return p.Cond()
+}
+
+/*Cond is right associative, "a ? b : c ? d : e" is "a ? b : (c ? d : e)",
+the "?" node has the condition and both branches as leafs
+*/
+func (p *Parser) Cond() *node {
+	cond := p.Cmp()
+	if p.word.val != "?" {
+		return cond
+	}
+	parent := newNode(p.word)
+	parent.AddLeaf(cond)
+	p.next()
+	parent.AddLeaf(p.Expr())
+	p.expect(":")
+	parent.AddLeaf(p.Cond())
+	return parent
+}
+
+var cmpOps = map[string]bool{
+	"==": true, "!=": true,
+	"<": true, "<=": true,
+	">": true, ">=": true,
+}
+
+/*Cmp is not associative, "a < b < c" is a syntax error
+ */
+func (p *Parser) Cmp() *node {
+	last := p.Sum()
+	if cmpOps[p.word.val] {
+		parent := newNode(p.word)
+		parent.AddLeaf(last)
+		p.next()
+		parent.AddLeaf(p.Sum())
+		return parent
+	}
+	return last
+}
+
+func (p *Parser) Sum() *node {
 	last := p.Term()
 	for p.word.val == "+" || p.word.val == "-" {
 		parent := newNode(p.word) // "+" or "-" node
@@ -86,12 +164,7 @@ func (p *Parser) Expr() *node {
 		parent.AddLeaf(p.Term())
 		last = parent
 	}
-	if p.word.val == ")" || p.word.tp == Teof {
-		p.next()
-		return last
-	}
-	p.Fail()
-	return nil
+	return last
 }
 
 func (p *Parser) Term() *node {
@@ -119,13 +192,18 @@ func (p *Parser) Unary() *node {
 func (p *Parser) Factor() *node {
 	if p.word.val == "(" {
 		p.next()
-		return p.Expr()
+		n := p.Expr()
+		p.expect(")")
+		return n
 	}
 	return p.Num()
 }
 
 func (p *Parser) Num() *node {
-	if p.word.tp == Tnum || p.word.tp == Targ {
+	if p.word.tp == Tid && !p.vars[p.word.val] {
+		log.Fatalf("Undefined variable: %v", p.word.val)
+	}
+	if p.word.tp == Tnum || p.word.tp == Targ || p.word.tp == Tid {
 		n := newNode(p.word)
 		p.next()
 		return n
@@ -0,0 +1,96 @@
+package main
+
+import "fmt"
+
+/*Target has what the backend needs to know about a machine: the registers
+the allocators can use, the templates of the instructions, and the runtime
+around the generated code. The GlobalAllocator only generates code through
+the Target, so each machine is a Target value (See X64 and A64), the local
+Allocator is written for x86-64 and is only in the Allocators of X64.
+
+The templates of Ops take the destination, both operands and the low byte
+of the destination, as registers unless Mem is set, in which case the second
+operand can also be in memory or an immediate of 32 bits. When TwoAddress
+is set the first operand is moved to the destination before the instruction.
+Division uses the registers at the indices in Div, and the dividend and the
+quotient are in the first one. Spilled values are loaded into the Scratch
+registers, if there are none the last allocated register is kept for them.
+OUT uses the Out template, or moves the result to the Result register.
+
+The Header converts the arguments to integers with atoi, the Tail prints
+the result with itoa and exits with status 0, and ArgCheck, Usage and
+DivZero exit with status 1
+*/
+type Target struct {
+	Name       string
+	Regs       []string
+	Low        []string
+	Scratch    []string
+	Div        []int
+	Mem        bool
+	TwoAddress bool
+	Ops        map[Operator]string
+
+	// Move, Load and LoadLit take the register and the source, Store the
+	// register and the address, Jz the operand and the label
+	Move, Load, LoadLit, Store string
+	Jmp, Jz, Out, DivCheck     string
+	Result                     string
+
+	Arg   func(idx int) string   // address of the argument
+	Slot  func(n int) string     // address of the nth spilled value
+	Frame func(slots int) string // reserves the spilled values
+
+	Allocators []string
+
+	Header, Tail, ArgCheck, Usage, DivZero string
+}
+
+var Targets = map[string]*Target{}
+
+func init() {
+	for _, t := range []*Target{X64, A64} {
+		Targets[t.Name] = t
+	}
+}
+
+/*Generate allocates the registers of the block with the allocator with
+the given name, using the first regs registers. It returns the assembly
+and the stores and loads of spilled values
+*/
+func (t *Target) Generate(b *Block, alloc string, regs int) (string, int, int) {
+	if alloc == "local" {
+		return genLocal(b, regs)
+	}
+	g := &GlobalAllocator{t: t, in: b, Regs: regs}
+	out := g.Begin()
+	return out, g.Stores, g.Loads
+}
+
+/*Assemble adds the Header and the Tail around the code of the
+allocators, frame has the code that reserves the stack used by them.
+ArgCheck and Usage are added if the code uses arguments,
+and DivZero if it divides
+*/
+func (t *Target) Assemble(in *Block, frame, body string) string {
+	out := t.Header
+	if n := in.MaxArg(); n > 0 {
+		out += fmt.Sprintf(t.ArgCheck, n+1)
+	}
+	out += frame + body + t.Tail
+	for _, ins := range *in {
+		if ins.Op == DIV {
+			out += t.DivZero
+			break
+		}
+	}
+	if n := in.MaxArg(); n > 0 {
+		out += fmt.Sprintf(t.Usage, n)
+	}
+	return out
+}
+
+/*needsCheck is false if the divisor is a literal other than zero*/
+func needsCheck(divisor *Operand) bool {
+	return divisor.Type != tNUMB || isLiteral(divisor, 0)
+}
@@ -1,37 +1,97 @@
 package main
 
-import (
-	"fmt"
-	"strconv"
-)
+import "strconv"
 
 type Machine struct {
 	Regs map[string]int
+	Out  []int // values printed by OUT
 }
 
-func (m *Machine) Run(code *Block) {
+/*Run executes the code keeping the results in Out, the error is ErrDivByZero
+ */
+func (m *Machine) Run(code *Block) (err error) {
+	defer catchDivByZero(&err)
 	m.Regs = make(map[string]int, 10)
+	m.Out = nil
+	labels := make(map[string]int, 4)
+	for i, ins := range *code {
+		if ins.Op == LABEL {
+			labels[ins.a.Data] = i
+		}
+	}
 	var a, b int
-	for _, ins := range *code {
-		if ins.a != nil {
-			a = m.GetOperand(ins.a)
+	for pc := 0; pc < len(*code); pc++ {
+		ins := (*code)[pc]
+		if ins.Op == LABEL || ins.Op == JMP {
+			if ins.Op == JMP {
+				pc = labels[ins.a.Data]
+			}
+			continue
 		}
-		if ins.b != nil {
+		a = m.GetOperand(ins.a)
+		if ins.c != nil {
 			b = m.GetOperand(ins.b)
 		}
 		switch ins.Op {
-		case ADD:
-			m.Regs[ins.c.Data] = a + b
-		case SUB:
-			m.Regs[ins.c.Data] = a - b
-		case MUL:
-			m.Regs[ins.c.Data] = a * b
-		case DIV:
-			m.Regs[ins.c.Data] = a / b
+		case MOV:
+			m.Regs[ins.b.Data] = a
+		case JZ:
+			if a == 0 {
+				pc = labels[ins.b.Data]
+			}
 		case OUT:
-			fmt.Println(a)
+			m.Out = append(m.Out, a)
+		default:
+			m.Regs[ins.c.Data] = Eval(ins.Op, a, b)
 		}
 	}
+	return nil
+}
+
+/*Eval computes the result of the instructions with 3 operands
+ */
+func Eval(op Operator, a, b int) int {
+	switch op {
+	case ADD:
+		return a + b
+	case SUB:
+		return a - b
+	case MUL:
+		return a * b
+	case DIV:
+		return divide(a, b)
+	case SHL:
+		return a << uint(b)
+	case SAR:
+		return a >> uint(b)
+	case SHR:
+		return int(uint64(a) >> uint(b))
+	}
+	return Compare(op, a, b)
+}
+
+/*Compare returns 1 if the comparison is true and 0 otherwise
+ */
+func Compare(op Operator, a, b int) int {
+	var out bool
+	switch op {
+	case EQ:
+		out = a == b
+	case NE:
+		out = a != b
+	case LT:
+		out = a < b
+	case LE:
+		out = a <= b
+	case GT:
+		out = a > b
+	case GE:
+		out = a >= b
+	}
+	if out {
+		return 1
+	}
+	return 0
 }
 
 func (m *Machine) GetOperand(op *Operand) int {
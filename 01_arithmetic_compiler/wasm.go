@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*OpToWAT has the instructions of the operations, the comparisons
+result in an i32, which is extended to the i64 of the registers
+*/
+var OpToWAT = map[Operator]string{
+	ADD: "i64.add",
+	SUB: "i64.sub",
+	MUL: "i64.mul",
+	DIV: "i64.div_s",
+	SHL: "i64.shl",
+	SAR: "i64.shr_s",
+	SHR: "i64.shr_u",
+
+	EQ: "i64.eq\ni64.extend_i32_u",
+	NE: "i64.ne\ni64.extend_i32_u",
+	LT: "i64.lt_s\ni64.extend_i32_u",
+	LE: "i64.le_s\ni64.extend_i32_u",
+	GT: "i64.gt_s\ni64.extend_i32_u",
+	GE: "i64.ge_s\ni64.extend_i32_u",
+}
+
+/*WAT lowers the 3 address code to a WebAssembly text module that exports
+main, with an i64 parameter for each argument up to the highest used, $1,
+$2..., returning the result. Wasm is a stack machine with any number of
+locals, so each virtual register is a local and nothing is allocated.
+Jumps only go forward, so each label is the end of a block opened at the
+start of the function, and a jump to it is a br out of that block:
+
+	block $L0
+	...
+	br_if $L0
+	...
+	end ;; L0
+
+A division by zero traps, since i64.div_s doesn't return
+*/
+func WAT(b Block) string {
+	params := ""
+	for i := 1; i <= b.MaxArg(); i++ {
+		params += fmt.Sprintf(" (param $%v i64)", i)
+	}
+	out := "(module\n"
+	out += fmt.Sprintf("\t(func (export \"main\")%v (result i64)\n", params)
+
+	labels := []string{}
+	seen := map[string]bool{}
+	for _, ins := range b {
+		if ins.Op == LABEL {
+			labels = append(labels, ins.a.Data)
+		}
+		if d := ins.Def(); isVReg(d) && !seen[d.String()] {
+			seen[d.String()] = true
+			out += fmt.Sprintf("\t\t(local $%v i64)\n", d)
+		}
+	}
+	open := len(labels)
+	indent := func() string {
+		return strings.Repeat("\t", 2+open)
+	}
+	for i := range labels { // the last label is the outermost block
+		out += strings.Repeat("\t", 2+i) + "block $" + labels[len(labels)-1-i] + "\n"
+	}
+	emit := func(s string) {
+		for _, line := range strings.Split(s, "\n") {
+			out += indent() + line + "\n"
+		}
+	}
+	for _, ins := range b {
+		switch ins.Op {
+		case LABEL:
+			open--
+			emit("end ;; " + ins.a.Data)
+		case JMP:
+			emit("br $" + ins.a.Data)
+		case JZ:
+			emit(watGet(ins.a))
+			emit("i64.eqz\nbr_if $" + ins.b.Data)
+		case OUT: // the result is what is left in the stack
+			emit(watGet(ins.a))
+		case MOV:
+			emit(watGet(ins.a))
+			emit("local.set $" + ins.b.String())
+		default:
+			emit(watGet(ins.a))
+			emit(watGet(ins.b))
+			emit(OpToWAT[ins.Op])
+			emit("local.set $" + ins.c.String())
+		}
+	}
+	return out + "\t)\n)\n"
+}
+
+/*watGet pushes the value of the operand*/
+func watGet(op *Operand) string {
+	if op.Type == tNUMB {
+		return "i64.const " + op.Data
+	}
+	return "local.get $" + strings.TrimPrefix(op.String(), "$")
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestWAT(t *testing.T) {
+	code, err := ParseIR(`
+		GT $1, $2 -> R0
+		JZ R0, L0
+		MOV $1 -> R1
+		JMP L1
+		L0:
+		MOV $2 -> R1
+		L1:
+		MUL R1, 8 -> R2
+		OUT R2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `(module
+	(func (export "main") (param $1 i64) (param $2 i64) (result i64)
+		(local $R0 i64)
+		(local $R1 i64)
+		(local $R2 i64)
+		block $L1
+			block $L0
+				local.get $1
+				local.get $2
+				i64.gt_s
+				i64.extend_i32_u
+				local.set $R0
+				local.get $R0
+				i64.eqz
+				br_if $L0
+				local.get $1
+				local.set $R1
+				br $L1
+			end ;; L0
+			local.get $2
+			local.set $R1
+		end ;; L1
+		local.get $R1
+		i64.const 8
+		i64.mul
+		local.set $R2
+		local.get $R2
+	)
+)
+`
+	if got := WAT(code); got != want {
+		t.Fatalf("got\n%v\nwanted\n%v", got, want)
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*Encoder translates the NASM generated by the allocators into machine code.
+It only knows the instructions used by them and by the Header and Tail,
+every operand is 64 bits unless it's a byte register or has the byte prefix.
+Jumps and calls always use 32 bit displacements, and symbols used as
+immediates always use 32 bits, so the size of the code doesn't depend on
+the addresses, which are only known after everything is encoded (See Encoder.Link)
+*/
+type Encoder struct {
+	Text, Data []byte
+	Bss        int // size of the uninitialized section
+
+	section string
+	label   string // label defined in the current line
+	Symbols map[string]*Symbol
+	fixups  []fixup
+}
+
+/*Symbol is a label, the offset is relative to the start of it's section.
+Constants (equ) have the value in Offset and no section
+*/
+type Symbol struct {
+	Section string
+	Offset  int
+}
+
+/*fixup is a 32 bit field in the text that depends on a symbol,
+relative fields are displacements from the end of the instruction
+*/
+type fixup struct {
+	at       int
+	symbol   string
+	relative bool
+}
+
+type operand struct {
+	kind byte // 'r' register, 'm' memory, 'i' immediate, 's' symbol
+	reg  int  // register, or base of memory
+	is8  bool // 8 bit register or memory
+	disp int  // displacement of memory
+	imm  int64
+	sym  string
+}
+
+var regNum = map[string]int{
+	"rax": 0, "rcx": 1, "rdx": 2, "rbx": 3, "rsp": 4, "rbp": 5, "rsi": 6, "rdi": 7,
+	"r8": 8, "r9": 9, "r10": 10, "r11": 11, "r12": 12, "r13": 13, "r14": 14, "r15": 15,
+}
+
+var reg8Num = map[string]int{
+	"al": 0, "cl": 1, "dl": 2, "bl": 3, "sil": 6, "dil": 7,
+	"r8b": 8, "r9b": 9, "r10b": 10, "r11b": 11, "r12b": 12, "r13b": 13, "r14b": 14, "r15b": 15,
+}
+
+/*aluOp has the opcodes of the two operand arithmetic instructions,
+r/m <- reg, reg <- r/m and the extension used with immediates
+*/
+var aluOp = map[string][3]byte{
+	"add": {0x01, 0x03, 0},
+	"sub": {0x29, 0x2B, 5},
+	"xor": {0x31, 0x33, 6},
+	"cmp": {0x39, 0x3B, 7},
+}
+
+var condCode = map[string]byte{
+	"e": 0x4, "ne": 0x5, "l": 0xC, "ge": 0xD, "le": 0xE, "g": 0xF,
+}
+
+/*Encode assembles the source, the errors have the line number
+ */
+func Encode(src string) (*Encoder, error) {
+	e := &Encoder{section: ".text", Symbols: map[string]*Symbol{}}
+	for i, line := range strings.Split(src, "\n") {
+		if err := e.line(stripComment(line)); err != nil {
+			return nil, fmt.Errorf("line %v: %v: %q", i+1, err, strings.TrimSpace(line))
+		}
+	}
+	return e, nil
+}
+
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (e *Encoder) line(line string) error {
+	line = strings.TrimSpace(line)
+	e.label = ""
+	if i := strings.Index(line, ":"); i > 0 && !strings.ContainsAny(line[:i], " \t\"[") {
+		if _, ok := e.Symbols[line[:i]]; ok {
+			return fmt.Errorf("%v already defined", line[:i])
+		}
+		e.Symbols[line[:i]] = &Symbol{e.section, e.here()}
+		e.label = line[:i]
+		line = strings.TrimSpace(line[i+1:])
+	}
+	if line == "" {
+		return nil
+	}
+	fields := strings.Fields(line)
+	name, rest := fields[0], strings.TrimSpace(line[len(fields[0]):])
+	switch name {
+	case "section":
+		e.section = rest
+		return nil
+	case "global":
+		return nil
+	case "resb":
+		n, err := strconv.Atoi(rest)
+		e.Bss += n
+		return err
+	case "db":
+		return e.db(rest)
+	case "equ":
+		return e.equ(rest)
+	}
+	if e.section != ".text" {
+		return fmt.Errorf("instruction outside of .text")
+	}
+	var ops []*operand
+	if rest != "" {
+		for _, s := range strings.Split(rest, ",") {
+			op, err := parseOperand(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		}
+	}
+	return e.instr(name, ops)
+}
+
+/*here is the offset of the next byte in the current section*/
+func (e *Encoder) here() int {
+	switch e.section {
+	case ".data":
+		return len(e.Data)
+	case ".bss":
+		return e.Bss
+	}
+	return len(e.Text)
+}
+
+func (e *Encoder) db(rest string) error {
+	for _, item := range strings.Split(rest, ",") {
+		item = strings.TrimSpace(item)
+		if strings.HasPrefix(item, "\"") && strings.HasSuffix(item, "\"") && len(item) > 1 {
+			e.Data = append(e.Data, item[1:len(item)-1]...)
+			continue
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			return err
+		}
+		e.Data = append(e.Data, byte(n))
+	}
+	return nil
+}
+
+/*equ only supports the length of the data after a label: $ - label,
+the label of the line becomes a constant
+*/
+func (e *Encoder) equ(rest string) error {
+	f := strings.Fields(rest)
+	if len(f) != 3 || f[0] != "$" || f[1] != "-" || e.label == "" {
+		return fmt.Errorf("expected label: equ $ - label")
+	}
+	sym, ok := e.Symbols[f[2]]
+	if !ok || sym.Section != e.section {
+		return fmt.Errorf("%v is not defined in %v", f[2], e.section)
+	}
+	e.Symbols[e.label] = &Symbol{"", e.here() - sym.Offset}
+	return nil
+}
+
+func parseOperand(s string) (*operand, error) {
+	op := &operand{}
+	switch {
+	case strings.HasPrefix(s, "qword "):
+		s = strings.TrimSpace(s[len("qword "):])
+	case strings.HasPrefix(s, "byte(") && strings.HasSuffix(s, ")"):
+		s = s[len("byte(") : len(s)-1]
+		op.is8 = true
+	case strings.HasPrefix(s, "byte "):
+		s = strings.TrimSpace(s[len("byte "):])
+		op.is8 = true
+	}
+	if r, ok := regNum[s]; ok {
+		op.kind, op.reg = 'r', r
+		return op, nil
+	}
+	if r, ok := reg8Num[s]; ok {
+		op.kind, op.reg, op.is8 = 'r', r, true
+		return op, nil
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return parseMemory(op, s[1:len(s)-1])
+	}
+	if len(s) == 3 && s[0] == '\'' && s[2] == '\'' {
+		op.kind, op.imm = 'i', int64(s[1])
+		return op, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		op.kind, op.imm = 'i', n
+		return op, nil
+	}
+	if s != "" && strings.IndexAny(s[:1], letters+"_") == 0 {
+		op.kind, op.sym = 's', s
+		return op, nil
+	}
+	return nil, fmt.Errorf("invalid operand %v", s)
+}
+
+/*parseMemory accepts a base register with an optional displacement*/
+func parseMemory(op *operand, s string) (*operand, error) {
+	op.kind = 'm'
+	base, disp := s, ""
+	if i := strings.IndexAny(s, "+-"); i > 0 {
+		base, disp = s[:i], strings.ReplaceAll(s[i:], " ", "")
+	}
+	r, ok := regNum[strings.TrimSpace(base)]
+	if !ok {
+		return nil, fmt.Errorf("invalid base register %v", base)
+	}
+	op.reg = r
+	if disp != "" {
+		d, err := strconv.Atoi(strings.TrimPrefix(disp, "+"))
+		if err != nil {
+			return nil, err
+		}
+		op.disp = d
+	}
+	return op, nil
+}
+
+func isImm8(n int64) bool    { return n >= -128 && n <= 127 }
+func fitsImm32(n int64) bool { return n >= -1<<31 && n < 1<<31 }
+
+func (e *Encoder) emit(b ...byte) {
+	e.Text = append(e.Text, b...)
+}
+
+func (e *Encoder) imm32(n int64) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(n))
+	e.emit(b[:]...)
+}
+
+/*rex emits the prefix if needed, w is for 64 bit operands, reg is the
+register in the reg field and rm the one in the r/m field (or the base),
+byte registers above bl need a prefix to not be read as ah, ch, dh and bh
+*/
+func (e *Encoder) rex(w bool, reg, rm *operand) {
+	b := byte(0x40)
+	if w {
+		b |= 8
+	}
+	if reg != nil && reg.reg >= 8 {
+		b |= 4
+	}
+	if rm != nil && rm.reg >= 8 {
+		b |= 1
+	}
+	needed := b != 0x40
+	for _, op := range []*operand{reg, rm} {
+		if op != nil && op.kind == 'r' && op.is8 && op.reg >= 4 {
+			needed = true
+		}
+	}
+	if needed {
+		e.emit(b)
+	}
+}
+
+/*modrm emits the ModRM byte, and the SIB and displacement for memory,
+RSP and R12 as base need a SIB byte, RBP and R13 always need a displacement
+*/
+func (e *Encoder) modrm(reg int, rm *operand) {
+	if rm.kind == 'r' {
+		e.emit(0xC0 | byte(reg&7)<<3 | byte(rm.reg&7))
+		return
+	}
+	mod := byte(0x80)
+	switch {
+	case rm.disp == 0 && rm.reg&7 != 5:
+		mod = 0
+	case isImm8(int64(rm.disp)):
+		mod = 0x40
+	}
+	e.emit(mod | byte(reg&7)<<3 | byte(rm.reg&7))
+	if rm.reg&7 == 4 {
+		e.emit(0x24)
+	}
+	switch mod {
+	case 0x40:
+		e.emit(byte(rm.disp))
+	case 0x80:
+		e.imm32(int64(rm.disp))
+	}
+}
+
+/*rm encodes an instruction with a register (or extension) and a r/m operand*/
+func (e *Encoder) rm(w bool, opcode []byte, reg *operand, ext int, rm *operand) {
+	e.rex(w, reg, rm)
+	e.emit(opcode...)
+	if reg != nil {
+		ext = reg.reg
+	}
+	e.modrm(ext, rm)
+}
+
+func (e *Encoder) symbol(name string, relative bool) {
+	e.fixups = append(e.fixups, fixup{len(e.Text), name, relative})
+	e.imm32(0)
+}
+
+func (e *Encoder) instr(name string, ops []*operand) error {
+	want := map[string]int{"cqo": 0, "syscall": 0, "ret": 0, "mov": 2, "imul": 2, "add": 2, "sub": 2, "xor": 2, "cmp": 2, "shl": 2, "sar": 2, "shr": 2}
+	n, ok := want[name]
+	if !ok {
+		n = 1
+	}
+	if len(ops) != n {
+		return fmt.Errorf("%v expects %v operands", name, n)
+	}
+	var a, b *operand
+	if n > 0 {
+		a = ops[0]
+	}
+	if n > 1 {
+		b = ops[1]
+		if a.kind != 'r' && a.kind != 'm' {
+			return fmt.Errorf("invalid destination")
+		}
+		if a.kind == 'm' && b.kind == 'm' {
+			return fmt.Errorf("two memory operands")
+		}
+		if a.kind == 'm' && b.is8 { // the size of memory comes from the other operand
+			a.is8 = true
+		}
+		if a.kind == 'r' && b.kind == 'r' && a.is8 != b.is8 {
+			return fmt.Errorf("operand sizes don't match")
+		}
+	}
+
+	switch name {
+	case "cqo":
+		e.emit(0x48, 0x99)
+	case "syscall":
+		e.emit(0x0F, 0x05)
+	case "ret":
+		e.emit(0xC3)
+	case "mov":
+		return e.mov(a, b)
+	case "add", "sub", "xor", "cmp":
+		return e.alu(aluOp[name], a, b)
+	case "imul":
+		switch b.kind {
+		case 'r', 'm':
+			e.rm(true, []byte{0x0F, 0xAF}, a, 0, b)
+		case 'i':
+			if a.kind != 'r' {
+				return fmt.Errorf("imul with an immediate needs a register")
+			}
+			if isImm8(b.imm) {
+				e.rm(true, []byte{0x6B}, a, 0, a)
+				e.emit(byte(b.imm))
+				return nil
+			}
+			if !fitsImm32(b.imm) {
+				return fmt.Errorf("immediate doesn't fit in 32 bits")
+			}
+			e.rm(true, []byte{0x69}, a, 0, a)
+			e.imm32(b.imm)
+		default:
+			return fmt.Errorf("invalid operand")
+		}
+	case "shl", "sar", "shr":
+		if a.kind != 'r' && a.kind != 'm' || a.is8 || b.kind != 'i' || b.imm < 0 || b.imm > 63 {
+			return fmt.Errorf("expected a shift by a literal from 0 to 63")
+		}
+		e.rm(true, []byte{0xC1}, nil, map[string]int{"shl": 4, "shr": 5, "sar": 7}[name], a)
+		e.emit(byte(b.imm))
+	case "idiv", "div", "inc", "dec":
+		if a.kind != 'r' && a.kind != 'm' || a.is8 {
+			return fmt.Errorf("invalid operand")
+		}
+		ext := map[string]int{"idiv": 7, "div": 6, "inc": 0, "dec": 1}[name]
+		opcode := byte(0xF7)
+		if name == "inc" || name == "dec" {
+			opcode = 0xFF
+		}
+		e.rm(true, []byte{opcode}, nil, ext, a)
+	case "push", "pop":
+		switch {
+		case a.kind == 'r' && !a.is8:
+			e.rex(false, nil, a)
+			base := byte(0x50)
+			if name == "pop" {
+				base = 0x58
+			}
+			e.emit(base + byte(a.reg&7))
+		case a.kind == 'm' && name == "push":
+			e.rm(false, []byte{0xFF}, nil, 6, a)
+		case a.kind == 'i' && name == "push" && isImm8(a.imm):
+			e.emit(0x6A, byte(a.imm))
+		case a.kind == 'i' && name == "push" && fitsImm32(a.imm):
+			e.emit(0x68)
+			e.imm32(a.imm)
+		default:
+			return fmt.Errorf("invalid operand")
+		}
+	case "call", "jmp":
+		if a.kind != 's' {
+			return fmt.Errorf("expected a label")
+		}
+		e.emit(map[string]byte{"call": 0xE8, "jmp": 0xE9}[name])
+		e.symbol(a.sym, true)
+	default:
+		if cc, ok := condCode[strings.TrimPrefix(name, "j")]; ok && name[0] == 'j' {
+			if a.kind != 's' {
+				return fmt.Errorf("expected a label")
+			}
+			e.emit(0x0F, 0x80|cc)
+			e.symbol(a.sym, true)
+			return nil
+		}
+		if cc, ok := condCode[strings.TrimPrefix(name, "set")]; ok && strings.HasPrefix(name, "set") {
+			if a.kind != 'r' || !a.is8 {
+				return fmt.Errorf("expected a byte register")
+			}
+			e.rm(false, []byte{0x0F, 0x90 | cc}, nil, 0, a)
+			return nil
+		}
+		return fmt.Errorf("unknown instruction %v", name)
+	}
+	return nil
+}
+
+func (e *Encoder) mov(a, b *operand) error {
+	switch {
+	case b.kind == 'r' && a.is8:
+		e.rm(false, []byte{0x88}, b, 0, a)
+	case b.kind == 'r':
+		e.rm(true, []byte{0x89}, b, 0, a)
+	case b.kind == 'm' && a.is8:
+		e.rm(false, []byte{0x8A}, a, 0, b)
+	case b.kind == 'm':
+		e.rm(true, []byte{0x8B}, a, 0, b)
+	case b.kind == 'i' && a.is8:
+		if a.kind == 'r' {
+			e.rex(false, nil, a)
+			e.emit(0xB0 + byte(a.reg&7))
+		} else {
+			e.rm(false, []byte{0xC6}, nil, 0, a)
+		}
+		e.emit(byte(b.imm))
+	case b.kind == 'i' && fitsImm32(b.imm):
+		e.rm(true, []byte{0xC7}, nil, 0, a)
+		e.imm32(b.imm)
+	case b.kind == 'i' && a.kind == 'r': // the only instruction with a 64 bit immediate
+		e.rex(true, nil, a)
+		e.emit(0xB8 + byte(a.reg&7))
+		var imm [8]byte
+		binary.LittleEndian.PutUint64(imm[:], uint64(b.imm))
+		e.emit(imm[:]...)
+	case b.kind == 's' && !a.is8:
+		e.rm(true, []byte{0xC7}, nil, 0, a)
+		e.symbol(b.sym, false)
+	default:
+		return fmt.Errorf("invalid operands")
+	}
+	return nil
+}
+
+func (e *Encoder) alu(op [3]byte, a, b *operand) error {
+	switch b.kind {
+	case 'r':
+		if a.is8 {
+			e.rm(false, []byte{op[0] - 1}, b, 0, a)
+			return nil
+		}
+		e.rm(true, []byte{op[0]}, b, 0, a)
+	case 'm':
+		if a.is8 {
+			e.rm(false, []byte{op[1] - 1}, a, 0, b)
+			return nil
+		}
+		e.rm(true, []byte{op[1]}, a, 0, b)
+	case 'i':
+		switch {
+		case a.is8:
+			e.rm(false, []byte{0x80}, nil, int(op[2]), a)
+			e.emit(byte(b.imm))
+		case isImm8(b.imm):
+			e.rm(true, []byte{0x83}, nil, int(op[2]), a)
+			e.emit(byte(b.imm))
+		case fitsImm32(b.imm):
+			e.rm(true, []byte{0x81}, nil, int(op[2]), a)
+			e.imm32(b.imm)
+		default:
+			return fmt.Errorf("immediate doesn't fit in 32 bits")
+		}
+	case 's':
+		if a.is8 {
+			return fmt.Errorf("invalid operands")
+		}
+		e.rm(true, []byte{0x81}, nil, int(op[2]), a)
+		e.symbol(b.sym, false)
+	default:
+		return fmt.Errorf("invalid operands")
+	}
+	return nil
+}
+
+/*Link writes the addresses of the symbols in the code, given the
+address where each section is loaded
+*/
+func (e *Encoder) Link(addr map[string]int) error {
+	for _, f := range e.fixups {
+		sym, ok := e.Symbols[f.symbol]
+		if !ok {
+			return fmt.Errorf("undefined symbol %v", f.symbol)
+		}
+		v := int64(sym.Offset)
+		if sym.Section != "" {
+			v += int64(addr[sym.Section])
+		}
+		if f.relative {
+			if sym.Section != ".text" {
+				return fmt.Errorf("can't jump to %v", f.symbol)
+			}
+			v -= int64(addr[".text"] + f.at + 4)
+		}
+		if !fitsImm32(v) {
+			return fmt.Errorf("address of %v doesn't fit in 32 bits", f.symbol)
+		}
+		binary.LittleEndian.PutUint32(e.Text[f.at:], uint32(v))
+	}
+	return nil
+}